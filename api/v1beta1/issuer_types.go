@@ -31,13 +31,60 @@ type IssuerSpec struct {
 
 	// Host remote FreeIPA server
 	// +kubebuilder:validation:MinLength=1
-	Host     string             `json:"host"`
-	User     *SecretKeySelector `json:"user"`
-	Password *SecretKeySelector `json:"password"`
+	// +optional
+	Host string `json:"host,omitempty"`
+
+	// Hosts remote FreeIPA servers, tried in order after Host
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Domain FreeIPA domain whose servers are discovered with the
+	// _ldap._tcp and _kerberos._tcp SRV records
+	// +optional
+	Domain string `json:"domain,omitempty"`
+
+	// Location IPA location whose servers are preferred during discovery
+	// +optional
+	Location string `json:"location,omitempty"`
+
+	// User to log in with. When a Keytab is set, it overrides the Kerberos
+	// principal read from the keytab.
+	// +optional
+	User *SecretKeySelector `json:"user,omitempty"`
+
+	// Password of the User. Not needed when a Keytab is set.
+	// +optional
+	Password *SecretKeySelector `json:"password,omitempty"`
+
+	// Keytab used to log in with Kerberos instead of a password
+	// +optional
+	Keytab *SecretKeySelector `json:"keytab,omitempty"`
+
+	// Realm Kerberos realm, defaults to the realm of the keytab principal
+	// +optional
+	Realm string `json:"realm,omitempty"`
+
+	// KDCs Kerberos KDC addresses, defaults to Host
+	// +optional
+	KDCs []string `json:"kdcs,omitempty"`
+
+	// ClientCertificate TLS Secret holding the client certificate and key
+	// used to log in with a certificate instead of a password. When set, User
+	// selects the IPA user the certificate is mapped to.
+	// +optional
+	ClientCertificate *corev1.SecretReference `json:"clientCertificate,omitempty"`
 
 	// +kubebuilder:default=HTTP
 	ServiceName string `json:"serviceName"`
 
+	// Principal Go template of the principal certificates are requested for,
+	// defaults to {{.ServiceName}}/{{.Host}}. It can use the fields CN, Host,
+	// DNSNames, ServiceName, Realm, Namespace, Name and Annotations, for
+	// instance {{.Annotations.service}}/{{.CN}}@{{.Realm}}. host/<fqdn> is a
+	// host principal and a name without instance a user principal.
+	// +optional
+	Principal string `json:"principal,omitempty"`
+
 	// +kubebuilder:default=true
 	AddHost bool `json:"addHost"`
 
@@ -47,12 +94,66 @@ type IssuerSpec struct {
 	// +kubebuilder:default=true
 	AddPrincipal bool `json:"addPrincipal"`
 
+	// AddManagedBy makes the hosts of the other DNS names of a certificate
+	// managed by the host of its principal, creating the hosts when needed,
+	// so that FreeIPA accepts them in the certificate
+	// +optional
+	AddManagedBy bool `json:"addManagedBy,omitempty"`
+
 	// +kubebuilder:default=ipa
 	Ca string `json:"ca"`
 
+	// Profile FreeIPA certificate profile used to sign certificates, defaults
+	// to the default profile of FreeIPA
+	// +optional
+	Profile string `json:"profile,omitempty"`
+
+	// AllowedProfiles certificate profiles a CertificateRequest may select
+	// with the freeipa.org/profile annotation
+	// +optional
+	AllowedProfiles []string `json:"allowedProfiles,omitempty"`
+
+	// ProfileMappings select the certificate profile from the duration and
+	// the usages of a CertificateRequest. The first matching mapping is used
+	// and requests matching none are not signed.
+	// +optional
+	ProfileMappings []ProfileMapping `json:"profileMappings,omitempty"`
+
+	// Revocation of the certificates signed by the issuer
+	// +optional
+	Revocation *RevocationSpec `json:"revocation,omitempty"`
+
+	// GarbageCollection of the hosts and services created by the issuer
+	// +optional
+	GarbageCollection *GarbageCollectionSpec `json:"garbageCollection,omitempty"`
+
+	// SubCA signs CA CertificateRequests with existing FreeIPA lightweight
+	// sub-CAs
+	// +optional
+	SubCA *SubCASpec `json:"subCA,omitempty"`
+
+	// Policy restricts the names and addresses of the certificates signed by
+	// the issuer. CertificateRequests breaking it are denied.
+	// +optional
+	Policy *Policy `json:"policy,omitempty"`
+
+	// DNS records created in the FreeIPA integrated DNS for the hosts created
+	// by the issuer
+	// +optional
+	DNS *DNSSpec `json:"dns,omitempty"`
+
 	// +kubebuilder:default=false
 	Insecure bool `json:"insecure"`
 
+	// CABundle PEM encoded CA certificates trusted to verify the FreeIPA server
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
+
+	// CABundleRef Secret or ConfigMap key holding PEM encoded CA certificates
+	// trusted to verify the FreeIPA server
+	// +optional
+	CABundleRef *CABundleReference `json:"caBundleRef,omitempty"`
+
 	// +kubebuilder:default=false
 	IgnoreError bool `json:"ignoreError"`
 }
@@ -64,6 +165,33 @@ type IssuerStatus struct {
 
 	// +optional
 	Conditions []IssuerCondition `json:"conditions,omitempty"`
+
+	// Servers health of the FreeIPA servers
+	// +optional
+	Servers []ServerStatus `json:"servers,omitempty"`
+
+	// ManagedEntries FreeIPA hosts, services, principal aliases and DNS
+	// records created by the issuer
+	// +optional
+	ManagedEntries []ManagedEntry `json:"managedEntries,omitempty"`
+}
+
+// ServerStatus contains the health of a FreeIPA server.
+type ServerStatus struct {
+	// Host of the FreeIPA server.
+	Host string `json:"host"`
+
+	// Healthy is false when the last call to the server failed.
+	Healthy bool `json:"healthy"`
+
+	// Message is the error of the last call to the server.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastCheckTime is the timestamp of the call that last changed the
+	// health of the server.
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -141,6 +269,212 @@ type IssuerCondition struct {
 	Message string `json:"message,omitempty"`
 }
 
+// ProfileMapping maps CertificateRequests to a certificate profile.
+type ProfileMapping struct {
+	// Profile FreeIPA certificate profile
+	Profile string `json:"profile"`
+
+	// MaxDuration longest certificate duration the profile is used for
+	// +optional
+	MaxDuration *metav1.Duration `json:"maxDuration,omitempty"`
+
+	// Usages key usages the profile issues, requests asking for other usages
+	// don't match
+	// +optional
+	Usages []string `json:"usages,omitempty"`
+}
+
+// RevocationPolicy tells when certificates are revoked.
+// +kubebuilder:validation:Enum=Never;OnDelete;OnSupersede
+type RevocationPolicy string
+
+const (
+	// RevocationPolicyNever never revokes certificates.
+	RevocationPolicyNever RevocationPolicy = "Never"
+
+	// RevocationPolicyOnDelete revokes the certificate of a
+	// CertificateRequest when it is deleted.
+	RevocationPolicyOnDelete RevocationPolicy = "OnDelete"
+
+	// RevocationPolicyOnSupersede revokes the certificate of a
+	// CertificateRequest once a newer CertificateRequest of the same
+	// Certificate is issued.
+	RevocationPolicyOnSupersede RevocationPolicy = "OnSupersede"
+)
+
+// RevocationSpec configures the revocation of certificates.
+type RevocationSpec struct {
+	// Policy tells when certificates are revoked
+	// +kubebuilder:default=Never
+	Policy RevocationPolicy `json:"policy"`
+
+	// Reason RFC 5280 revocation reason code
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=10
+	// +optional
+	Reason int `json:"reason,omitempty"`
+}
+
+// GarbageCollectionSpec configures the removal of the hosts and services
+// created by the issuer once no certificate uses them.
+type GarbageCollectionSpec struct {
+	// Enabled deletes the unused hosts and services
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// GracePeriod how long a host or service is kept once unused, 24h by
+	// default
+	// +optional
+	GracePeriod *metav1.Duration `json:"gracePeriod,omitempty"`
+
+	// DryRun only reports the hosts and services to delete in the status of
+	// the issuer
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// SubCASpec configures the lightweight sub-CAs signing CA
+// CertificateRequests.
+type SubCASpec struct {
+	// Enabled signs CA CertificateRequests with lightweight sub-CAs, which
+	// are otherwise failed
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// AllowedNames glob patterns the names of the sub-CAs, the common names of
+	// the requests, must match
+	// +optional
+	AllowedNames []string `json:"allowedNames,omitempty"`
+}
+
+// Policy restricts what an issuer signs. DNS name patterns are either a name
+// or a wildcard such as *.example.com, matching every name under the domain.
+type Policy struct {
+	// AllowedDNSNames patterns every DNS name must match, any name when empty
+	// +optional
+	AllowedDNSNames []string `json:"allowedDNSNames,omitempty"`
+
+	// DeniedDNSNames patterns no DNS name may match
+	// +optional
+	DeniedDNSNames []string `json:"deniedDNSNames,omitempty"`
+
+	// AllowedServiceNames service names the principals may use, any service
+	// name when empty
+	// +optional
+	AllowedServiceNames []string `json:"allowedServiceNames,omitempty"`
+
+	// AllowedIPRanges CIDRs every IP address must be in, no IP address is
+	// allowed when empty
+	// +optional
+	AllowedIPRanges []string `json:"allowedIPRanges,omitempty"`
+}
+
+// DNSSpec creates DNS records for the hosts created by an issuer. The targets
+// of the records come from the freeipa.org/dns-targets annotation of the
+// CertificateRequest, else from the Ingress or Service owning its Certificate
+// with FromOwner, else from Targets.
+type DNSSpec struct {
+	// Enabled creates the DNS records
+	Enabled bool `json:"enabled"`
+
+	// Zones FreeIPA DNS zones the records are created in. Hosts in none of
+	// them get no record.
+	Zones []string `json:"zones"`
+
+	// Targets of the records: IP addresses for A and AAAA records, or a
+	// single host name for a CNAME record
+	// +optional
+	Targets []string `json:"targets,omitempty"`
+
+	// FromOwner takes the targets from the load balancer status of the
+	// Ingress or Service owning the Certificate of the CertificateRequest
+	// +optional
+	FromOwner bool `json:"fromOwner,omitempty"`
+}
+
+// ManagedEntryKind is the kind of a FreeIPA entry.
+// +kubebuilder:validation:Enum=Host;Service;PrincipalAlias;DNSRecord
+type ManagedEntryKind string
+
+const (
+	// ManagedEntryHost is a FreeIPA host.
+	ManagedEntryHost ManagedEntryKind = "Host"
+
+	// ManagedEntryService is a FreeIPA service.
+	ManagedEntryService ManagedEntryKind = "Service"
+
+	// ManagedEntryPrincipalAlias is a principal alias of a FreeIPA service
+	// or host.
+	ManagedEntryPrincipalAlias ManagedEntryKind = "PrincipalAlias"
+
+	// ManagedEntryDNSRecord is a record of the FreeIPA integrated DNS.
+	ManagedEntryDNSRecord ManagedEntryKind = "DNSRecord"
+)
+
+// ManagedEntry is a FreeIPA host, service, principal alias or DNS record
+// created by the issuer.
+type ManagedEntry struct {
+	// Kind of the entry, Host, Service, PrincipalAlias or DNSRecord.
+	Kind ManagedEntryKind `json:"kind"`
+
+	// Name is the FQDN of a host or a DNS record, or the principal of a
+	// service or an alias.
+	Name string `json:"name"`
+
+	// Principal of the service or host a principal alias was added to.
+	// +optional
+	Principal string `json:"principal,omitempty"`
+
+	// Zone of a DNS record.
+	// +optional
+	Zone string `json:"zone,omitempty"`
+
+	// RecordType of a DNS record, A, AAAA or CNAME.
+	// +optional
+	RecordType string `json:"recordType,omitempty"`
+
+	// Target of a DNS record, an IP address or a host name.
+	// +optional
+	Target string `json:"target,omitempty"`
+
+	// CertificateRequest the entry was created for, as namespace/name.
+	CertificateRequest string `json:"certificateRequest"`
+
+	// UnusedSince is the timestamp from which no CertificateRequest nor
+	// Certificate uses the entry.
+	// +optional
+	UnusedSince *metav1.Time `json:"unusedSince,omitempty"`
+
+	// PendingDeletion is set in dry run mode on the entries that would be
+	// deleted.
+	// +optional
+	PendingDeletion bool `json:"pendingDeletion,omitempty"`
+}
+
+const (
+	// ProfileAnnotation is the CertificateRequest annotation selecting the
+	// certificate profile, among the AllowedProfiles of the issuer.
+	ProfileAnnotation = "freeipa.org/profile"
+
+	// DNSTargetsAnnotation is the CertificateRequest annotation holding the
+	// comma separated targets of the DNS records of its hosts.
+	DNSTargetsAnnotation = "freeipa.org/dns-targets"
+
+	// DNSPendingAnnotation marks the issued CertificateRequests whose DNS
+	// records could not be set yet, which are retried.
+	DNSPendingAnnotation = "freeipa.org/dns-pending"
+
+	// InFlightAnnotation is the CertificateRequest annotation holding the
+	// time its signing started. Retries look for the certificate FreeIPA may
+	// have issued since, instead of requesting another one.
+	InFlightAnnotation = "freeipa.org/in-flight"
+
+	// RequestIDAnnotation is the CertificateRequest annotation holding the ID
+	// of the FreeIPA certificate request waiting for the approval of a CA
+	// agent.
+	RequestIDAnnotation = "freeipa.org/request-id"
+)
+
 // SecretKeySelector selects a key of a Secret.
 type SecretKeySelector struct {
 	// The name and namespace of the secret to select from.
@@ -149,6 +483,25 @@ type SecretKeySelector struct {
 	Key string `json:"key" protobuf:"bytes,2,opt,name=key"`
 }
 
+// ConfigMapKeySelector selects a key of a ConfigMap.
+type ConfigMapKeySelector struct {
+	// The name of the ConfigMap to select from.
+	Name string `json:"name"`
+	// The namespace of the ConfigMap to select from.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// The key of the ConfigMap to select from.
+	Key string `json:"key"`
+}
+
+// CABundleReference selects a key of either a Secret or a ConfigMap.
+type CABundleReference struct {
+	// +optional
+	Secret *SecretKeySelector `json:"secret,omitempty"`
+	// +optional
+	ConfigMap *ConfigMapKeySelector `json:"configMap,omitempty"`
+}
+
 func init() {
 	SchemeBuilder.Register(&Issuer{}, &IssuerList{})
 }
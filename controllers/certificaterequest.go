@@ -2,7 +2,10 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
 	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
@@ -13,25 +16,38 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+const (
+	minPendingBackoff = 30 * time.Second
+	maxPendingBackoff = 10 * time.Minute
+)
+
 // CertificateRequestReconciler implements a controller that reconciles CertificateRequests
 // that references this controller.
 type CertificateRequestReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 
+	// Registry holds the provisioners of the issuers.
+	Registry *provisioners.Registry
+
 	Clock                  clock.Clock
 	CheckApprovedCondition bool
 }
 
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests/finalizers,verbs=update
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
 
 // Reconcile reconciles CertificateRequest by fetching a Cloudflare API provisioner from
 // the referenced Issuer, and providing the request's CSR.
@@ -57,13 +73,26 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req reconc
 		return reconcile.Result{}, nil
 	}
 
+	if !cr.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, cr)
+	}
+
 	// Ignore CertificateRequest if it is already Ready
 	if cmutil.CertificateRequestHasCondition(cr, certmanager.CertificateRequestCondition{
 		Type:   certmanager.CertificateRequestConditionReady,
 		Status: cmmeta.ConditionTrue,
 	}) {
+		result := reconcile.Result{}
+		if _, ok := cr.Annotations[api.DNSPendingAnnotation]; ok {
+			log.Info("CertificateRequest is Ready, setting its DNS records")
+			var err error
+			if result, err = r.retryDNSRecords(ctx, cr); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
 		log.V(4).Info("CertificateRequest is Ready. Ignoring.")
-		return reconcile.Result{}, nil
+		return result, r.revokeSuperseded(ctx, cr)
 	}
 	// Ignore CertificateRequest if it is already Failed
 	if cmutil.CertificateRequestHasCondition(cr, certmanager.CertificateRequestCondition{
@@ -89,13 +118,8 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req reconc
 	if cmutil.CertificateRequestIsDenied(cr) {
 		log.V(4).Info("CertificateRequest has been denied. Marking as failed.")
 
-		if cr.Status.FailureTime == nil {
-			nowTime := metav1.NewTime(r.Clock.Now())
-			cr.Status.FailureTime = &nowTime
-		}
-
 		message := "The CertificateRequest was denied by an approval controller"
-		return reconcile.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonDenied, message)
+		return reconcile.Result{}, r.fail(ctx, cr, certmanager.CertificateRequestReasonDenied, message)
 	}
 
 	if r.CheckApprovedCondition {
@@ -112,68 +136,258 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req reconc
 		return reconcile.Result{}, nil
 	}
 
-	if cr.Spec.IsCA {
-		log.Info("FreeIPA Issuer does not support signing of CA certificates")
+	log.Info("validation ok")
 
-		return reconcile.Result{}, nil
+	issNamespaceName := issuerName(cr)
+
+	kind := cr.Spec.IssuerRef.Kind
+	if kind != "ClusterIssuer" {
+		kind = "Issuer"
 	}
 
-	log.Info("validation ok")
+	iss, spec, status, err := r.getIssuer(ctx, cr)
+	if err != nil {
+		log.Error(err, "failed to retrieve issuer resource", "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Failed to retrieve %s resource %s: %v", kind, issNamespaceName, err))
 
-	var issNamespaceName types.NamespacedName
+		return reconcile.Result{}, err
+	}
 
-	if cr.Spec.IssuerRef.Kind == "Issuer" {
-		iss := api.Issuer{}
-		issNamespaceName = types.NamespacedName{
-			Namespace: req.Namespace,
-			Name:      cr.Spec.IssuerRef.Name,
-		}
+	if !iss.GetDeletionTimestamp().IsZero() {
+		err := fmt.Errorf("resource %s is being deleted", issNamespaceName)
+		log.Error(err, "issuer is being deleted", "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("%s %s is being deleted", kind, issNamespaceName))
+
+		return reconcile.Result{}, err
+	}
+
+	if !issuerHasCondition(*status, api.IssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue}) {
+		err := fmt.Errorf("resource %s is not ready", issNamespaceName)
+		log.Error(err, "issuer failed readiness checks", "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("%s %s is not Ready", kind, issNamespaceName))
+
+		return reconcile.Result{}, err
+	}
+
+	log.WithValues("issuer", issNamespaceName).Info("process")
+
+	p, err := r.loadProvisioner(ctx, cr, iss, spec)
+	if err != nil {
+		log.Error(err, "failed to provisioner for Issuer resource")
+		r.checkRefused(ctx, cr, err)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Failed to load provisioner for Issuer resource %s: %v", issNamespaceName, err))
+		return reconcile.Result{}, err
+	}
 
-		if err := r.Client.Get(ctx, issNamespaceName, &iss); err != nil {
-			log.Error(err, "failed to retrieve Issuer resource", "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
-			_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Failed to retrieve Issuer resource %s: %v", issNamespaceName, err))
+	// The provisioner must have been built from the current spec.
+	if generation, _ := r.Registry.Generation(issNamespaceName); generation != iss.GetGeneration() {
+		err := fmt.Errorf("provisioner %s was built from generation %d instead of %d", issNamespaceName, generation, iss.GetGeneration())
+		log.Error(err, "outdated provisioner for Issuer resource")
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Waiting for the provisioner of %s %s to be updated", kind, issNamespaceName))
+		return reconcile.Result{}, err
+	}
 
+	// Keep the CertificateRequest until its certificate is revoked.
+	if p.RevocationPolicy() != api.RevocationPolicyNever && !controllerutil.ContainsFinalizer(cr, revocationFinalizer) {
+		controllerutil.AddFinalizer(cr, revocationFinalizer)
+		if err := r.Client.Update(ctx, cr); err != nil {
+			log.Error(err, "failed to add revocation finalizer")
 			return reconcile.Result{}, err
 		}
+	}
 
-		if !issuerHasCondition(iss, api.IssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue}) {
-			err := fmt.Errorf("resource %s is not ready", issNamespaceName)
-			log.Error(err, "issuer failed readiness checks", "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
-			_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Issuer %s is not Ready", issNamespaceName))
-
+	// Record the signing attempt before FreeIPA issues anything, so that a
+	// retry finds the certificate if the controller stops before storing it.
+	// The first attempt has nothing to find, and is signed without the
+	// record.
+	signed := cr
+	if _, ok := cr.Annotations[api.InFlightAnnotation]; !ok && !cr.Spec.IsCA {
+		metav1.SetMetaDataAnnotation(&cr.ObjectMeta, api.InFlightAnnotation, r.Clock.Now().UTC().Format(time.RFC3339))
+		if err := r.Client.Update(ctx, cr); err != nil {
+			log.Error(err, "failed to record signing attempt")
 			return reconcile.Result{}, err
 		}
-	} else if cr.Spec.IssuerRef.Kind == "ClusterIssuer" {
-		issNamespaceName = types.NamespacedName{
-			Namespace: "",
-			Name:      cr.Spec.IssuerRef.Name,
+
+		signed = cr.DeepCopy()
+		delete(signed.Annotations, api.InFlightAnnotation)
+	}
+
+	cert, ca, created, err := p.Sign(ctx, signed)
+	records, deleted, dnsSet := r.setDNSRecords(ctx, p, cr, created, status.ManagedEntries)
+	created = append(created, records...)
+	if len(created) > 0 || len(deleted) > 0 {
+		if err := r.recordEntries(ctx, cr, created, deleted); err != nil {
+			log.Error(err, "failed to record created hosts and services in issuer status")
 		}
 	}
+	var pendingErr *provisioners.PendingError
+	if errors.As(err, &pendingErr) {
+		id := strconv.Itoa(pendingErr.RequestID)
+		if cr.Annotations[api.RequestIDAnnotation] != id {
+			metav1.SetMetaDataAnnotation(&cr.ObjectMeta, api.RequestIDAnnotation, id)
+			if err := r.Client.Update(ctx, cr); err != nil {
+				log.Error(err, "failed to store FreeIPA certificate request ID", "requestID", id)
+				return reconcile.Result{}, err
+			}
+		}
 
-	log.WithValues("issuer", issNamespaceName).Info("process")
+		log.Info("certificate request waits for approval", "requestID", id)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Waiting for a CA agent to approve FreeIPA certificate request %s", id))
 
-	// Load the provisioner that will sign the CertificateRequest
-	p, ok := provisioners.Load(issNamespaceName)
-	if !ok {
-		err := fmt.Errorf("provisioner %s not found", issNamespaceName)
-		log.Error(err, "failed to provisioner for Issuer resource")
-		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Failed to load provisioner for Issuer resource %s", issNamespaceName))
-		return reconcile.Result{}, err
+		return reconcile.Result{RequeueAfter: r.pendingBackoff(cr)}, nil
+	}
+	for _, f := range signFailures {
+		if errors.As(err, f.err) {
+			log.Error(err, f.log)
+			return reconcile.Result{}, r.fail(ctx, cr, f.reason, fmt.Sprintf("%s: %s", f.message, errorMessage(err)))
+		}
 	}
+	r.checkRefused(ctx, cr, err)
+	if provisioners.IsTransient(err) {
+		log.Error(err, "failed to sign certificate request, retrying")
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonPending, fmt.Sprintf("Failed to sign certificate request, retrying: %s", errorMessage(err)))
 
-	cert, ca, err := p.Sign(ctx, cr)
+		return reconcile.Result{RequeueAfter: r.pendingBackoff(cr)}, nil
+	}
 	if err != nil {
 		log.Error(err, "failed to sign certificate request")
-		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, certmanager.CertificateRequestReasonFailed, fmt.Sprintf("Failed to sign certificate request: %v", err))
+		_ = r.fail(ctx, cr, certmanager.CertificateRequestReasonFailed, fmt.Sprintf("Failed to sign certificate request: %s", errorMessage(err)))
 
 		return reconcile.Result{}, err
 	}
 
+	// DNS records which could not be set are retried once the
+	// CertificateRequest is issued.
+	if !dnsSet {
+		metav1.SetMetaDataAnnotation(&cr.ObjectMeta, api.DNSPendingAnnotation, "true")
+		if err := r.Client.Update(ctx, cr); err != nil {
+			log.Error(err, "failed to mark DNS records as pending")
+		}
+	}
+
 	cr.Status.Certificate = cert
 	cr.Status.CA = ca
 	_ = r.setStatus(ctx, cr, cmmeta.ConditionTrue, certmanager.CertificateRequestReasonIssued, "Certificate issued")
 
-	return reconcile.Result{}, nil
+	result := reconcile.Result{}
+	if !dnsSet {
+		result.RequeueAfter = r.pendingBackoff(cr)
+	}
+
+	return result, r.revokeSuperseded(ctx, cr)
+}
+
+// signFailure is a signing error that fails the CertificateRequest for good.
+type signFailure struct {
+	// err points to the error type, as errors.As takes it
+	err interface{}
+	// reason of the Ready condition
+	reason string
+	// message of the Ready condition, before the error
+	message string
+	// log message
+	log string
+}
+
+// signFailures are the signing errors failing the CertificateRequest, the
+// others being retried.
+var signFailures = []signFailure{
+	{new(*provisioners.ProfileError), certmanager.CertificateRequestReasonFailed, "No certificate profile for the request", "no certificate profile for certificate request"},
+	{new(*provisioners.PolicyError), certmanager.CertificateRequestReasonDenied, "Denied by the issuer policy", "certificate request denied by issuer policy"},
+	{new(*provisioners.PrincipalError), certmanager.CertificateRequestReasonFailed, "No principal for the request", "no principal for certificate request"},
+	{new(*provisioners.SubCAError), certmanager.CertificateRequestReasonFailed, "Failed to sign CA certificate request", "failed to sign CA certificate request"},
+	{new(*provisioners.RejectedError), certmanager.CertificateRequestReasonFailed, "FreeIPA did not issue the certificate", "certificate request rejected"},
+	{new(*provisioners.CSRError), certmanager.CertificateRequestReasonFailed, "Invalid certificate signing request", "invalid certificate signing request"},
+	{new(*provisioners.DeniedError), certmanager.CertificateRequestReasonFailed, "FreeIPA denied the issuer account", "issuer account not allowed to sign certificate request"},
+	{new(*provisioners.NotFoundError), certmanager.CertificateRequestReasonFailed, "FreeIPA entry not found", "FreeIPA entry of certificate request not found"},
+}
+
+// fail sets the Ready condition of the CertificateRequest to False with a
+// final reason, Failed or Denied, and its FailureTime if not already.
+func (r *CertificateRequestReconciler) fail(ctx context.Context, cr *certmanager.CertificateRequest, reason, message string) error {
+	if cr.Status.FailureTime == nil {
+		nowTime := metav1.NewTime(r.Clock.Now())
+		cr.Status.FailureTime = &nowTime
+	}
+
+	return r.setStatus(ctx, cr, cmmeta.ConditionFalse, reason, message)
+}
+
+// checkRefused sets the issuer of the CertificateRequest not ready when
+// FreeIPA refused its credentials, so that no request logs in with them
+// until the issuer is reconciled with new ones.
+func (r *CertificateRequestReconciler) checkRefused(ctx context.Context, cr *certmanager.CertificateRequest, err error) {
+	if err == nil || provisioners.Reason(err) != provisioners.ReasonAuthenticationFailed {
+		return
+	}
+
+	message := fmt.Sprintf("FreeIPA refused the credentials of the issuer: %v", err)
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		iss, status := newIssuerOf(cr)
+		if err := r.Client.Get(ctx, issuerName(cr), iss); err != nil {
+			return err
+		}
+
+		SetIssuerCondition(ctx, status, api.ConditionReady, api.ConditionFalse, provisioners.ReasonAuthenticationFailed, message)
+
+		return r.Client.Status().Update(ctx, iss)
+	}); err != nil {
+		log.FromContext(ctx).Error(err, "failed to set issuer not ready")
+	}
+}
+
+// loadProvisioner returns the provisioner of the issuer of the
+// CertificateRequest, building it when the issuer was not reconciled yet,
+// such as after a restart.
+func (r *CertificateRequestReconciler) loadProvisioner(ctx context.Context, cr *certmanager.CertificateRequest, iss client.Object, spec *api.IssuerSpec) (*provisioners.FreeIPAPKI, error) {
+	issNamespaceName := issuerName(cr)
+
+	// The provisioner of a deleted issuer is not built again once removed.
+	if !iss.GetDeletionTimestamp().IsZero() {
+		return nil, fmt.Errorf("resource %s is being deleted", issNamespaceName)
+	}
+
+	return r.Registry.LoadOrBuild(ctx, issNamespaceName, func() (*provisioners.FreeIPAPKI, int64, error) {
+		log.FromContext(ctx).Info("building provisioner for Issuer resource", "issuer", issNamespaceName)
+		creds, err := initSecrets(ctx, r.Client, ctrl.Request{NamespacedName: issNamespaceName}, spec)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to retrieve auth secret: %w", err)
+		}
+
+		p, err := r.Registry.New(issNamespaceName, spec, creds)
+		return p, iss.GetGeneration(), err
+	})
+}
+
+// pendingBackoff returns when to check again a certificate request waiting
+// for approval or for FreeIPA to be reachable: the delay doubles from
+// minPendingBackoff while it waits, up to maxPendingBackoff.
+func (r *CertificateRequestReconciler) pendingBackoff(cr *certmanager.CertificateRequest) time.Duration {
+	delay := minPendingBackoff
+
+	cond := cmutil.GetCertificateRequestCondition(cr, certmanager.CertificateRequestConditionReady)
+	if cond != nil && cond.LastTransitionTime != nil {
+		delay = r.Clock.Since(cond.LastTransitionTime.Time)
+	}
+
+	if delay < minPendingBackoff {
+		return minPendingBackoff
+	}
+	if delay > maxPendingBackoff {
+		return maxPendingBackoff
+	}
+
+	return delay
+}
+
+// errorMessage returns the message of a signing error for the Ready
+// condition, with the code and name of the FreeIPA error behind it.
+func errorMessage(err error) string {
+	if ipaErr := provisioners.FreeIPAError(err); ipaErr != nil {
+		return fmt.Sprintf("%v [FreeIPA error %d %s]", err, ipaErr.Code, ipaErr.Name)
+	}
+
+	return err.Error()
 }
 
 // setStatus is a helper function to set the CertifcateRequest status condition with reason and message, and update the API.
@@ -189,13 +403,41 @@ func (r *CertificateRequestReconciler) SetupWithManager(mgr ctrl.Manager) error
 		Complete(r)
 }
 
-// issuerHasCondition will return true if the given Issuer resource has
+// issuerName returns the name of the Issuer or ClusterIssuer referenced by
+// the CertificateRequest.
+func issuerName(cr *certmanager.CertificateRequest) types.NamespacedName {
+	if cr.Spec.IssuerRef.Kind == "ClusterIssuer" {
+		return types.NamespacedName{Name: cr.Spec.IssuerRef.Name}
+	}
+
+	return types.NamespacedName{Namespace: cr.Namespace, Name: cr.Spec.IssuerRef.Name}
+}
+
+// getIssuer returns the Issuer or ClusterIssuer referenced by the
+// CertificateRequest, with its spec and status.
+func (r *CertificateRequestReconciler) getIssuer(ctx context.Context, cr *certmanager.CertificateRequest) (client.Object, *api.IssuerSpec, *api.IssuerStatus, error) {
+	if cr.Spec.IssuerRef.Kind == "ClusterIssuer" {
+		iss := &api.ClusterIssuer{}
+		if err := r.Client.Get(ctx, issuerName(cr), iss); err != nil {
+			return nil, nil, nil, err
+		}
+		return iss, &iss.Spec, &iss.Status, nil
+	}
+
+	iss := &api.Issuer{}
+	if err := r.Client.Get(ctx, issuerName(cr), iss); err != nil {
+		return nil, nil, nil, err
+	}
+	return iss, &iss.Spec, &iss.Status, nil
+}
+
+// issuerHasCondition will return true if the given Issuer status has
 // a condition matching the provided IssuerCondition. Only the Type and
 // Status field will be used in the comparison, meaning that this function will
 // return 'true' even if the Reason, Message and LastTransitionTime fields do
 // not match.
-func issuerHasCondition(iss api.Issuer, c api.IssuerCondition) bool {
-	existingConditions := iss.Status.Conditions
+func issuerHasCondition(status api.IssuerStatus, c api.IssuerCondition) bool {
+	existingConditions := status.Conditions
 	for _, cond := range existingConditions {
 		if c.Type == cond.Type && c.Status == cond.Status {
 			return true
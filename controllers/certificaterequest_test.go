@@ -1,5 +1,294 @@
 package controllers
 
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmutil "github.com/jetstack/cert-manager/pkg/api/util"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+// newCSR returns a PEM encoded CSR for the common name.
+func newCSR(t *testing.T, commonName string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+// newScheme returns a scheme with the Kubernetes, cert-manager and issuer
+// types.
+func newScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := certmanager.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	return scheme
+}
+
+// fakeMethod answers a JSON-RPC call with the content of the "result" field.
+type fakeMethod func(options map[string]interface{}) interface{}
+
+// newFakeIPA starts a FreeIPA stand-in accepting any password, and returns
+// its host. It answers the calls of the given methods, and is unavailable
+// for the others.
+func newFakeIPA(t *testing.T, methods map[string]fakeMethod) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipa/session/login_password", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "ipa_session", Value: "session", Path: "/ipa", Secure: true})
+	})
+	mux.HandleFunc("/ipa/session/json", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m, ok := methods[req.Method]
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var options map[string]interface{}
+		if len(req.Params) == 2 {
+			options, _ = req.Params[1].(map[string]interface{})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": m(options), "error": nil})
+	})
+
+	ipa := httptest.NewTLSServer(mux)
+	t.Cleanup(ipa.Close)
+
+	return strings.TrimPrefix(ipa.URL, "https://")
+}
+
+func TestCertificateRequestReconciler_signFailures(t *testing.T) {
+	scheme := newScheme(t)
+
+	clock := clocktesting.NewFakeClock(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	now := metav1.NewTime(clock.Now())
+	pendingSince := metav1.NewTime(clock.Now().Add(-2 * time.Minute))
+
+	issuerName := types.NamespacedName{Name: "ipa", Namespace: "default"}
+	issuer := &api.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: issuerName.Name, Namespace: issuerName.Namespace, Generation: 1},
+		Spec: api.IssuerSpec{
+			// FreeIPA is unavailable, so that signing fails with a
+			// transport error once the request passes the checks of the
+			// issuer.
+			Host:        newFakeIPA(t, nil),
+			Insecure:    true,
+			ServiceName: "HTTP",
+			Ca:          "ipa",
+			Policy:      &api.Policy{AllowedDNSNames: []string{"*.example.test"}},
+		},
+		Status: api.IssuerStatus{Conditions: []api.IssuerCondition{{Type: api.ConditionReady, Status: api.ConditionTrue}}},
+	}
+
+	tests := []struct {
+		name        string
+		request     []byte
+		conditions  []certmanager.CertificateRequestCondition
+		wantReason  string
+		wantResult  reconcile.Result
+		wantFailure bool
+	}{
+		{
+			name:       "FreeIPA unavailable",
+			request:    newCSR(t, "www.example.test"),
+			wantReason: certmanager.CertificateRequestReasonPending,
+			wantResult: reconcile.Result{RequeueAfter: minPendingBackoff},
+		},
+		{
+			name:    "FreeIPA unavailable for a while",
+			request: newCSR(t, "www.example.test"),
+			conditions: []certmanager.CertificateRequestCondition{
+				{Type: certmanager.CertificateRequestConditionReady, Status: cmmeta.ConditionFalse, Reason: certmanager.CertificateRequestReasonPending, LastTransitionTime: &pendingSince},
+			},
+			wantReason: certmanager.CertificateRequestReasonPending,
+			wantResult: reconcile.Result{RequeueAfter: 2 * time.Minute},
+		},
+		{
+			name:        "denied by the issuer policy",
+			request:     newCSR(t, "www.other.test"),
+			wantReason:  certmanager.CertificateRequestReasonDenied,
+			wantFailure: true,
+		},
+		{
+			name:        "invalid CSR",
+			request:     []byte("not a CSR"),
+			wantReason:  certmanager.CertificateRequestReasonFailed,
+			wantFailure: true,
+		},
+		{
+			name:    "denied by an approver",
+			request: newCSR(t, "www.example.test"),
+			conditions: []certmanager.CertificateRequestCondition{
+				{Type: certmanager.CertificateRequestConditionDenied, Status: cmmeta.ConditionTrue},
+			},
+			wantReason:  certmanager.CertificateRequestReasonDenied,
+			wantFailure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &certmanager.CertificateRequest{
+				ObjectMeta: metav1.ObjectMeta{Name: "www", Namespace: "default"},
+				Spec: certmanager.CertificateRequestSpec{
+					Request:   tt.request,
+					IssuerRef: cmmeta.ObjectReference{Name: issuerName.Name, Kind: "Issuer", Group: api.GroupVersion.Group},
+				},
+				Status: certmanager.CertificateRequestStatus{Conditions: tt.conditions},
+			}
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(issuer.DeepCopy(), cr).Build()
+
+			registry := provisioners.NewRegistry(provisioners.DefaultClusterName)
+			p, err := provisioners.New(issuerName, issuer.Spec.DeepCopy(), &provisioners.Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			registry.Store(issuerName, 1, p)
+			defer registry.Delete(issuerName)
+
+			r := &CertificateRequestReconciler{Client: c, Scheme: scheme, Registry: registry, Clock: clock}
+			result, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "www", Namespace: "default"}})
+			if err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			if result != tt.wantResult {
+				t.Errorf("Reconcile() = %+v, want %+v", result, tt.wantResult)
+			}
+
+			got := &certmanager.CertificateRequest{}
+			if err := c.Get(context.Background(), types.NamespacedName{Name: "www", Namespace: "default"}, got); err != nil {
+				t.Fatal(err)
+			}
+			cond := cmutil.GetCertificateRequestCondition(got, certmanager.CertificateRequestConditionReady)
+			if cond == nil || cond.Status != cmmeta.ConditionFalse || cond.Reason != tt.wantReason {
+				t.Errorf("Ready condition = %+v, want False %s", cond, tt.wantReason)
+			}
+			if tt.wantFailure {
+				if got.Status.FailureTime == nil || !got.Status.FailureTime.Equal(&now) {
+					t.Errorf("FailureTime = %v, want %v", got.Status.FailureTime, now)
+				}
+			} else if got.Status.FailureTime != nil {
+				t.Errorf("FailureTime = %v, want none", got.Status.FailureTime)
+			}
+		})
+	}
+}
+
+func TestCertificateRequestReconciler_refused(t *testing.T) {
+	scheme := newScheme(t)
+
+	var mu sync.Mutex
+	var logins int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipa/session/login_password", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		logins++
+		mu.Unlock()
+		w.Header().Set("X-IPA-Rejection-Reason", "invalid-password")
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	ipa := httptest.NewTLSServer(mux)
+	defer ipa.Close()
+
+	issuerName := types.NamespacedName{Name: "ipa", Namespace: "default"}
+	issuer := &api.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: issuerName.Name, Namespace: issuerName.Namespace, Generation: 1},
+		Spec: api.IssuerSpec{
+			Host:     strings.TrimPrefix(ipa.URL, "https://"),
+			Insecure: true,
+			Ca:       "ipa",
+			User:     &api.SecretKeySelector{SecretReference: corev1.SecretReference{Name: "ipa"}, Key: "user"},
+			Password: &api.SecretKeySelector{SecretReference: corev1.SecretReference{Name: "ipa"}, Key: "password"},
+		},
+		Status: api.IssuerStatus{Conditions: []api.IssuerCondition{{Type: api.ConditionReady, Status: api.ConditionTrue}}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ipa", Namespace: "default"},
+		Data:       map[string][]byte{"user": []byte("admin"), "password": []byte("wrong")},
+	}
+	cr := &certmanager.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "www", Namespace: "default"},
+		Spec: certmanager.CertificateRequestSpec{
+			Request:   newCSR(t, "www.example.test"),
+			IssuerRef: cmmeta.ObjectReference{Name: issuerName.Name, Kind: "Issuer", Group: api.GroupVersion.Group},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(issuer, secret, cr).Build()
+	r := &CertificateRequestReconciler{Client: c, Scheme: scheme, Registry: provisioners.NewRegistry(provisioners.DefaultClusterName), Clock: clocktesting.NewFakeClock(time.Now())}
+
+	// The refused credentials set the issuer not ready, so that the
+	// following requests wait for it instead of logging in again.
+	for i := 0; i < 3; i++ {
+		if _, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "www", Namespace: "default"}}); err == nil {
+			t.Fatal("Reconcile() error = nil, want an error")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if logins != 1 {
+		t.Errorf("got %d logins, want 1", logins)
+	}
+
+	got := &api.Issuer{}
+	if err := c.Get(context.Background(), issuerName, got); err != nil {
+		t.Fatal(err)
+	}
+	if !issuerHasCondition(got.Status, api.IssuerCondition{Type: api.ConditionReady, Status: api.ConditionFalse}) || got.Status.Conditions[0].Reason != provisioners.ReasonAuthenticationFailed {
+		t.Errorf("conditions = %+v, want Ready False %s", got.Status.Conditions, provisioners.ReasonAuthenticationFailed)
+	}
+}
+
 // import (
 // 	"context"
 // 	"crypto/x509"
@@ -19,13 +19,20 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
 	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
@@ -35,9 +42,17 @@ import (
 type ClusterIssuerReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Registry holds the provisioners of the issuers.
+	Registry *provisioners.Registry
+
+	// CheckInterval is the interval between two checks of the FreeIPA setup
+	// of a ClusterIssuer. Zero disables the periodic checks.
+	CheckInterval time.Duration
 }
 
 // +kubebuilder:rbac:groups=certmanager.freeipa.org,resources=clusterissuers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=certmanager.freeipa.org,resources=clusterissuers/finalizers,verbs=update
 // +kubebuilder:rbac:groups=certmanager.freeipa.org,resources=clusterissuers/status,verbs=get;update;patch
 
 func (r *ClusterIssuerReconciler) Reconcile(ctx context.Context, req reconcile.Request) (ctrl.Result, error) {
@@ -45,11 +60,28 @@ func (r *ClusterIssuerReconciler) Reconcile(ctx context.Context, req reconcile.R
 
 	iss := new(api.ClusterIssuer)
 	if err := r.Client.Get(ctx, req.NamespacedName, iss); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Info("ClusterIssuer is gone, removing its provisioner")
+			r.Registry.Delete(req.NamespacedName)
+			return reconcile.Result{}, nil
+		}
+
 		log.Error(err, "failed to retrieve ClusterIssuer resource")
-		return reconcile.Result{}, client.IgnoreNotFound(err)
+		return reconcile.Result{}, err
+	}
+
+	// A deleted ClusterIssuer signs no more certificates, and releases its entries.
+	if !iss.DeletionTimestamp.IsZero() {
+		log.Info("ClusterIssuer is being deleted, removing its provisioner")
+		return reconcile.Result{}, finalizeIssuer(ctx, r.Client, r.Registry, req, iss, &iss.Spec, &iss.Status, cmmeta.ObjectReference{Kind: "ClusterIssuer", Name: iss.Name})
 	}
 
-	user, password, err := initSecrets(ctx, r.Client, req, *iss.Spec.User, *iss.Spec.Password)
+	if err := addIssuerFinalizer(ctx, r.Client, iss); err != nil {
+		log.Error(err, "failed to add finalizer")
+		return reconcile.Result{}, err
+	}
+
+	creds, err := initSecrets(ctx, r.Client, req, &iss.Spec)
 
 	if err != nil {
 		log.Error(err, "failed to retieve Issuer auth secret")
@@ -63,17 +95,58 @@ func (r *ClusterIssuerReconciler) Reconcile(ctx context.Context, req reconcile.R
 		return reconcile.Result{}, err
 	}
 
-	// Initialize and store the provisioner
-	p, err := provisioners.New(req.NamespacedName, &iss.Spec, string(user), string(password), iss.Spec.Insecure)
+	// Reuse the provisioner of the same spec and credentials, following the
+	// SRV records of its domain, else initialize and store a new one
+	p, ok := r.Registry.LoadCurrent(req.NamespacedName, iss.Generation, creds)
+	if ok {
+		if err := p.Discover(); err != nil {
+			log.Error(err, "failed to discover FreeIPA servers, keeping the known ones")
+		}
+	} else {
+		p, err = r.newProvisioner(ctx, iss, req, creds)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	// Check the setup now and again every CheckInterval
+	result := reconcile.Result{RequeueAfter: r.CheckInterval}
+
+	err = p.Verify(ctx)
+	iss.Status.Servers = p.ServerStatuses()
+	if err != nil {
+		log.Error(err, "failed to verify ClusterIssuer")
+
+		return result, r.setStatus(ctx, iss, api.ConditionFalse, provisioners.Reason(err), fmt.Sprintf("Failed to verify ClusterIssuer: %v", err))
+	}
+
+	if err := collectGarbage(ctx, r.Client, p, &iss.Spec, &iss.Status); err != nil {
+		log.Error(err, "failed to collect unused hosts and services")
+	}
+
+	return result, r.setStatus(ctx, iss, api.ConditionTrue, "Verified", "ClusterIssuer verified and ready to sign certificates")
+}
+
+// newProvisioner initializes and stores the provisioner of the ClusterIssuer.
+func (r *ClusterIssuerReconciler) newProvisioner(ctx context.Context, iss *api.ClusterIssuer, req ctrl.Request, creds *provisioners.Credentials) (*provisioners.FreeIPAPKI, error) {
+	log := log.FromContext(ctx)
+
+	p, err := r.Registry.New(req.NamespacedName, &iss.Spec, creds)
 	if err != nil {
 		log.Error(err, "failed to create provisioner")
-		_ = r.setStatus(ctx, iss, api.ConditionFalse, "Error", "Failed initialize provisioner")
-		return reconcile.Result{}, err
+
+		if provisioners.IsTLSVerificationError(err) {
+			_ = r.setStatus(ctx, iss, api.ConditionFalse, provisioners.ReasonTLSVerificationFailed, fmt.Sprintf("Failed to verify FreeIPA server certificate: %v", err))
+		} else {
+			_ = r.setStatus(ctx, iss, api.ConditionFalse, provisioners.Reason(err), fmt.Sprintf("Failed to initialize provisioner: %v", err))
+		}
+
+		return nil, err
 	}
 
-	provisioners.Store(req.NamespacedName, p)
+	r.Registry.Store(req.NamespacedName, iss.Generation, p)
 
-	return reconcile.Result{}, r.setStatus(ctx, iss, api.ConditionTrue, "Verified", "ClusterIssuer verified and ready to sign certificates")
+	return p, nil
 }
 
 // setStatus is a helper function to set the Issuer status condition with reason and message, and update the API.
@@ -85,6 +158,27 @@ func (r *ClusterIssuerReconciler) setStatus(ctx context.Context, iss *api.Cluste
 
 func (r *ClusterIssuerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&api.ClusterIssuer{}).
+		For(&api.ClusterIssuer{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.clusterIssuersReferencing)).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.clusterIssuersReferencing)).
 		Complete(r)
 }
+
+// clusterIssuersReferencing returns a request for every ClusterIssuer referencing obj, so
+// that their provisioner is rebuilt when a Secret or ConfigMap changes.
+func (r *ClusterIssuerReconciler) clusterIssuersReferencing(obj client.Object) []reconcile.Request {
+	issuers := new(api.ClusterIssuerList)
+	if err := r.Client.List(context.Background(), issuers); err != nil {
+		log.Log.Error(err, "failed to list ClusterIssuers", "object", client.ObjectKeyFromObject(obj))
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, iss := range issuers.Items {
+		if referencesObject(&iss.Spec, iss.Namespace, obj) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&iss)})
+		}
+	}
+
+	return requests
+}
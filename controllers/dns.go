@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+// setDNSRecords sets the DNS records of the hosts of the CertificateRequest
+// the issuer manages, the created ones and the ones of its names it created
+// before, and returns the records it created and deleted. It reports whether
+// the records are set: failing to set them does not fail the request, but
+// they are retried.
+func (r *CertificateRequestReconciler) setDNSRecords(ctx context.Context, p *provisioners.FreeIPAPKI, cr *certmanager.CertificateRequest, created, managed []api.ManagedEntry) ([]api.ManagedEntry, []api.ManagedEntry, bool) {
+	log := log.FromContext(ctx)
+
+	dns := p.DNS()
+	if dns == nil {
+		return nil, nil, true
+	}
+
+	hosts := dnsHosts(cr, append(append([]api.ManagedEntry(nil), created...), managed...))
+	if len(hosts) == 0 {
+		return nil, nil, true
+	}
+
+	targets, err := dnsTargets(ctx, r.Client, cr, dns)
+	if err != nil {
+		log.Error(err, "failed to get DNS targets")
+		return nil, nil, false
+	}
+	if len(targets) == 0 {
+		log.Info("no DNS target for the hosts yet", "hosts", hosts)
+		return nil, nil, false
+	}
+
+	added, deleted, err := p.SetDNSRecords(ctx, cr, hosts, targets, managed)
+	if err != nil {
+		log.Error(err, "failed to set DNS records", "hosts", hosts)
+		return added, deleted, false
+	}
+
+	return added, deleted, true
+}
+
+// dnsHosts returns the hosts among the entries which were created for the
+// CertificateRequest or are named by its CSR.
+func dnsHosts(cr *certmanager.CertificateRequest, entries []api.ManagedEntry) []string {
+	names := map[string]bool{}
+	if csr, err := pki.DecodeX509CertificateRequestBytes(cr.Spec.Request); err == nil {
+		for _, name := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+			names[strings.ToLower(name)] = true
+		}
+	}
+	owner := cr.Namespace + "/" + cr.Name
+
+	var hosts []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		host := strings.ToLower(entry.Name)
+		if entry.Kind != api.ManagedEntryHost || seen[host] {
+			continue
+		}
+		if entry.CertificateRequest == owner || names[host] {
+			hosts = append(hosts, entry.Name)
+			seen[host] = true
+		}
+	}
+
+	return hosts
+}
+
+// retryDNSRecords sets the DNS records of an issued CertificateRequest which
+// could not be set when it was signed, until they are.
+func (r *CertificateRequestReconciler) retryDNSRecords(ctx context.Context, cr *certmanager.CertificateRequest) (reconcile.Result, error) {
+	iss, spec, status, err := r.getIssuer(ctx, cr)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	// The records of a deleted issuer are not set any more.
+	if err == nil && iss.GetDeletionTimestamp().IsZero() {
+		p, err := r.loadProvisioner(ctx, cr, iss, spec)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		added, deleted, done := r.setDNSRecords(ctx, p, cr, nil, status.ManagedEntries)
+		if len(added) > 0 || len(deleted) > 0 {
+			if err := r.recordEntries(ctx, cr, added, deleted); err != nil {
+				log.FromContext(ctx).Error(err, "failed to record DNS records in issuer status")
+			}
+		}
+		if !done {
+			return reconcile.Result{RequeueAfter: r.pendingBackoff(cr)}, nil
+		}
+	}
+
+	delete(cr.Annotations, api.DNSPendingAnnotation)
+
+	return reconcile.Result{}, r.Client.Update(ctx, cr)
+}
+
+// dnsTargets returns the targets of the DNS records of a CertificateRequest:
+// the ones of its annotation, else the load balancer addresses of the owner
+// of its Certificate, else the static ones of the issuer.
+func dnsTargets(ctx context.Context, c client.Client, cr *certmanager.CertificateRequest, dns *api.DNSSpec) ([]string, error) {
+	if v, ok := cr.Annotations[api.DNSTargetsAnnotation]; ok {
+		var targets []string
+		for _, target := range strings.Split(v, ",") {
+			if target = strings.TrimSpace(target); target != "" {
+				targets = append(targets, target)
+			}
+		}
+		return targets, nil
+	}
+
+	if dns.FromOwner {
+		targets, err := ownerTargets(ctx, c, cr)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) > 0 {
+			return targets, nil
+		}
+	}
+
+	return dns.Targets, nil
+}
+
+// ownerTargets returns the load balancer IP addresses of the Ingress or
+// Service owning the Certificate of the CertificateRequest, or its first host
+// name without IP address.
+func ownerTargets(ctx context.Context, c client.Client, cr *certmanager.CertificateRequest) ([]string, error) {
+	ref := ownerReference(cr.OwnerReferences, certmanager.SchemeGroupVersion.String(), "Certificate")
+	if ref == nil {
+		return nil, nil
+	}
+
+	crt := &certmanager.Certificate{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: ref.Name}, crt); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	var status corev1.LoadBalancerStatus
+	if ref := ownerReference(crt.OwnerReferences, networkingv1.SchemeGroupVersion.String(), "Ingress"); ref != nil {
+		ing := &networkingv1.Ingress{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: ref.Name}, ing); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		status = ing.Status.LoadBalancer
+	} else if ref := ownerReference(crt.OwnerReferences, corev1.SchemeGroupVersion.String(), "Service"); ref != nil {
+		svc := &corev1.Service{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: ref.Name}, svc); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		status = svc.Status.LoadBalancer
+	}
+
+	// A CNAME record has a single target, so host names are only used
+	// without IP address.
+	var ips, hostnames []string
+	for _, ingress := range status.Ingress {
+		switch {
+		case ingress.IP != "":
+			ips = append(ips, ingress.IP)
+		case ingress.Hostname != "":
+			hostnames = append(hostnames, ingress.Hostname)
+		}
+	}
+	if len(ips) == 0 && len(hostnames) > 0 {
+		return hostnames[:1], nil
+	}
+
+	return ips, nil
+}
+
+// ownerReference returns the owner reference of the API version and kind.
+func ownerReference(refs []metav1.OwnerReference, apiVersion, kind string) *metav1.OwnerReference {
+	for i := range refs {
+		if refs[i].APIVersion == apiVersion && refs[i].Kind == kind {
+			return &refs[i]
+		}
+	}
+
+	return nil
+}
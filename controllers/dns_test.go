@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+func Test_dnsTargets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := certmanager.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	owned := func(apiVersion, kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: name}}
+	}
+	objects := []client.Object{
+		&certmanager.Certificate{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "www", OwnerReferences: owned("networking.k8s.io/v1", "Ingress", "www")}},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "www"},
+			Status: networkingv1.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{
+				{Hostname: "lb.example.test"},
+				{IP: "10.0.0.1"},
+			}}},
+		},
+		&certmanager.Certificate{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ldap", OwnerReferences: owned("v1", "Service", "ldap")}},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ldap"},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{
+				{Hostname: "lb1.example.test"},
+				{Hostname: "lb2.example.test"},
+			}}},
+		},
+		&certmanager.Certificate{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pending", OwnerReferences: owned("networking.k8s.io/v1", "Ingress", "pending")}},
+		&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pending"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+
+	dns := &api.DNSSpec{Enabled: true, Zones: []string{"example.test"}, Targets: []string{"192.0.2.1"}, FromOwner: true}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		owner       string
+		want        []string
+	}{
+		{
+			name:        "annotation",
+			annotations: map[string]string{api.DNSTargetsAnnotation: "10.0.0.2, 2001:db8::2"},
+			owner:       "www",
+			want:        []string{"10.0.0.2", "2001:db8::2"},
+		},
+		{
+			name:  "ingress",
+			owner: "www",
+			want:  []string{"10.0.0.1"},
+		},
+		{
+			name:  "service",
+			owner: "ldap",
+			want:  []string{"lb1.example.test"},
+		},
+		{
+			name:  "owner without address",
+			owner: "pending",
+			want:  []string{"192.0.2.1"},
+		},
+		{
+			name:  "owner not found",
+			owner: "gone",
+			want:  []string{"192.0.2.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &certmanager.CertificateRequest{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            tt.owner + "-1",
+				Annotations:     tt.annotations,
+				OwnerReferences: owned("cert-manager.io/v1", "Certificate", tt.owner),
+			}}
+
+			got, err := dnsTargets(context.Background(), c, cr, dns)
+			if err != nil {
+				t.Fatalf("dnsTargets() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dnsTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsHosts(t *testing.T) {
+	cr := &certmanager.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "www-1"},
+		Spec:       certmanager.CertificateRequestSpec{Request: newCSR(t, "WWW.example.test")},
+	}
+	entries := []api.ManagedEntry{
+		{Kind: api.ManagedEntryHost, Name: "www.example.test", CertificateRequest: "default/www-0"},
+		{Kind: api.ManagedEntryHost, Name: "principal.example.test", CertificateRequest: "default/www-1"},
+		{Kind: api.ManagedEntryHost, Name: "other.example.test", CertificateRequest: "default/other"},
+		{Kind: api.ManagedEntryService, Name: "HTTP/www.example.test", CertificateRequest: "default/www-1"},
+		{Kind: api.ManagedEntryHost, Name: "www.example.test", CertificateRequest: "default/www-1"},
+	}
+
+	want := []string{"www.example.test", "principal.example.test"}
+	if got := dnsHosts(cr, entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("dnsHosts() = %v, want %v", got, want)
+	}
+}
+
+func TestCertificateRequestReconciler_retryDNSRecords(t *testing.T) {
+	var mu sync.Mutex
+	var added []string
+	host := newFakeIPA(t, map[string]fakeMethod{
+		"dnsrecord_add": func(options map[string]interface{}) interface{} {
+			name, _ := options["idnsname"].(string)
+			records, _ := options["arecord"].([]interface{})
+			mu.Lock()
+			for _, record := range records {
+				added = append(added, name+" "+record.(string))
+			}
+			mu.Unlock()
+			return map[string]interface{}{"value": name, "result": map[string]interface{}{"idnsname": []interface{}{name}}}
+		},
+		"dnsrecord_del": func(options map[string]interface{}) interface{} {
+			name, _ := options["idnsname"].(string)
+			return map[string]interface{}{"value": []interface{}{name}, "result": map[string]interface{}{"failed": []interface{}{}}}
+		},
+	})
+
+	tests := []struct {
+		name        string
+		targets     string
+		wantAdded   []string
+		wantPending bool
+		wantEntries []api.ManagedEntry
+	}{
+		{
+			name:      "new target",
+			targets:   "10.0.0.2",
+			wantAdded: []string{"www 10.0.0.2"},
+			wantEntries: []api.ManagedEntry{
+				{Kind: api.ManagedEntryHost, Name: "www.example.test", CertificateRequest: "default/www-1"},
+				{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.2", CertificateRequest: "default/www-2"},
+			},
+		},
+		{
+			name:        "no target",
+			wantPending: true,
+			wantEntries: []api.ManagedEntry{
+				{Kind: api.ManagedEntryHost, Name: "www.example.test", CertificateRequest: "default/www-1"},
+				{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.1", CertificateRequest: "default/www-1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			added = nil
+			mu.Unlock()
+
+			issuerName := types.NamespacedName{Name: "ipa", Namespace: "default"}
+			issuer := &api.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: issuerName.Name, Namespace: issuerName.Namespace, Generation: 1},
+				Spec: api.IssuerSpec{
+					Host:     host,
+					Insecure: true,
+					Ca:       "ipa",
+					DNS:      &api.DNSSpec{Enabled: true, Zones: []string{"example.test"}},
+				},
+				Status: api.IssuerStatus{ManagedEntries: []api.ManagedEntry{
+					{Kind: api.ManagedEntryHost, Name: "www.example.test", CertificateRequest: "default/www-1"},
+					{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.1", CertificateRequest: "default/www-1"},
+				}},
+			}
+			cr := &certmanager.CertificateRequest{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "www-2",
+					Namespace:   "default",
+					Annotations: map[string]string{api.DNSPendingAnnotation: "true"},
+				},
+				Spec: certmanager.CertificateRequestSpec{
+					Request:   newCSR(t, "www.example.test"),
+					IssuerRef: cmmeta.ObjectReference{Name: issuerName.Name, Kind: "Issuer", Group: api.GroupVersion.Group},
+				},
+			}
+			if tt.targets != "" {
+				cr.Annotations[api.DNSTargetsAnnotation] = tt.targets
+			}
+
+			registry := provisioners.NewRegistry(provisioners.DefaultClusterName)
+			p, err := registry.New(issuerName, issuer.Spec.DeepCopy(), &provisioners.Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			registry.Store(issuerName, 1, p)
+			t.Cleanup(func() { registry.Delete(issuerName) })
+
+			c := fake.NewClientBuilder().WithScheme(newScheme(t)).WithObjects(issuer, cr).Build()
+			r := &CertificateRequestReconciler{Client: c, Registry: registry, Clock: clocktesting.NewFakeClock(time.Now())}
+
+			result, err := r.retryDNSRecords(context.Background(), cr)
+			if err != nil {
+				t.Fatalf("retryDNSRecords() error = %v", err)
+			}
+			if got := result.RequeueAfter > 0; got != tt.wantPending {
+				t.Errorf("retryDNSRecords() requeued = %v, want %v", got, tt.wantPending)
+			}
+
+			mu.Lock()
+			got := append([]string(nil), added...)
+			mu.Unlock()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantAdded) {
+				t.Errorf("added records = %v, want %v", got, tt.wantAdded)
+			}
+
+			stored := &certmanager.CertificateRequest{}
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(cr), stored); err != nil {
+				t.Fatal(err)
+			}
+			if _, pending := stored.Annotations[api.DNSPendingAnnotation]; pending != tt.wantPending {
+				t.Errorf("DNS pending annotation = %v, want %v", pending, tt.wantPending)
+			}
+
+			iss := &api.Issuer{}
+			if err := c.Get(context.Background(), issuerName, iss); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(iss.Status.ManagedEntries, tt.wantEntries) {
+				t.Errorf("managed entries = %v, want %v", iss.Status.ManagedEntries, tt.wantEntries)
+			}
+		})
+	}
+}
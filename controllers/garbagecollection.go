@@ -0,0 +1,397 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+const (
+	// defaultGracePeriod is how long unused hosts and services are kept when
+	// the issuer does not set a grace period.
+	defaultGracePeriod = 24 * time.Hour
+
+	// issuerFinalizer keeps an issuer until the entries it created in FreeIPA
+	// are deleted.
+	issuerFinalizer = "freeipa.org/managed-entries"
+)
+
+// recordEntries adds the hosts and services created for the
+// CertificateRequest to the status of its issuer, and removes the deleted
+// ones.
+func (r *CertificateRequestReconciler) recordEntries(ctx context.Context, cr *certmanager.CertificateRequest, entries, deleted []api.ManagedEntry) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		iss, status := newIssuerOf(cr)
+		if err := r.Client.Get(ctx, issuerName(cr), iss); err != nil {
+			return err
+		}
+
+		status.ManagedEntries = removeEntries(addEntries(status.ManagedEntries, entries), deleted)
+
+		return r.Client.Status().Update(ctx, iss)
+	})
+}
+
+// newIssuerOf returns an empty object of the kind of the issuer of the
+// CertificateRequest, with its status.
+func newIssuerOf(cr *certmanager.CertificateRequest) (client.Object, *api.IssuerStatus) {
+	if cr.Spec.IssuerRef.Kind == "ClusterIssuer" {
+		clusterIssuer := &api.ClusterIssuer{}
+		return clusterIssuer, &clusterIssuer.Status
+	}
+
+	issuer := &api.Issuer{}
+	return issuer, &issuer.Status
+}
+
+// addIssuerFinalizer adds the finalizer releasing the entries of the issuer
+// when it is deleted.
+func addIssuerFinalizer(ctx context.Context, c client.Client, iss client.Object) error {
+	if controllerutil.ContainsFinalizer(iss, issuerFinalizer) {
+		return nil
+	}
+
+	controllerutil.AddFinalizer(iss, issuerFinalizer)
+
+	return c.Update(ctx, iss)
+}
+
+// finalizeIssuer removes the provisioner of a deleted issuer, so that it
+// signs no more certificates, then deletes its entries from FreeIPA and
+// removes its finalizer. Entries are left in FreeIPA when the credentials of
+// the issuer are gone.
+func finalizeIssuer(ctx context.Context, c client.Client, registry *provisioners.Registry, req ctrl.Request, iss client.Object, spec *api.IssuerSpec, status *api.IssuerStatus, ref cmmeta.ObjectReference) error {
+	log := log.FromContext(ctx)
+
+	registry.Delete(req.NamespacedName)
+
+	if !controllerutil.ContainsFinalizer(iss, issuerFinalizer) {
+		return nil
+	}
+
+	if len(status.ManagedEntries) > 0 {
+		creds, err := initSecrets(ctx, c, req, spec)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Info("credentials are gone, leaving the managed entries in FreeIPA", "reason", err.Error())
+		case err != nil:
+			return err
+		default:
+			p, err := registry.New(req.NamespacedName, spec, creds)
+			if err != nil {
+				log.Error(err, "failed to create provisioner")
+				return err
+			}
+
+			err = releaseEntries(ctx, c, p, spec, status, ref, req.Namespace)
+			p.Close()
+			if err != nil {
+				if updateErr := c.Status().Update(ctx, iss); updateErr != nil {
+					log.Error(updateErr, "failed to update managed entries")
+				}
+				return err
+			}
+		}
+	}
+
+	controllerutil.RemoveFinalizer(iss, issuerFinalizer)
+
+	return c.Update(ctx, iss)
+}
+
+// addEntries adds the entries not already in the list.
+func addEntries(list []api.ManagedEntry, entries []api.ManagedEntry) []api.ManagedEntry {
+	for _, entry := range entries {
+		found := false
+		for i := range list {
+			if sameEntry(list[i], entry) {
+				list[i].UnusedSince = nil
+				list[i].PendingDeletion = false
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// removeEntries removes the deleted entries from the list.
+func removeEntries(list []api.ManagedEntry, deleted []api.ManagedEntry) []api.ManagedEntry {
+	var kept []api.ManagedEntry
+	for _, entry := range list {
+		found := false
+		for _, d := range deleted {
+			found = found || sameEntry(entry, d)
+		}
+		if !found {
+			kept = append(kept, entry)
+		}
+	}
+
+	return kept
+}
+
+// sameEntry reports whether two entries are the same FreeIPA entry: DNS
+// records of a name may have several targets, and principal aliases of a name
+// belong to a principal.
+func sameEntry(a, b api.ManagedEntry) bool {
+	return a.Kind == b.Kind && a.Name == b.Name && a.Principal == b.Principal &&
+		a.Zone == b.Zone && a.RecordType == b.RecordType && a.Target == b.Target
+}
+
+// collectGarbage deletes from FreeIPA the hosts, services and principal
+// aliases of the status that no CertificateRequest nor Certificate of the
+// cluster has used for the grace period. In dry run mode, they are only marked
+// as pending deletion. Without garbage collection, principal aliases are
+// still removed once unused, without grace period.
+func collectGarbage(ctx context.Context, c client.Client, p *provisioners.FreeIPAPKI, spec *api.IssuerSpec, status *api.IssuerStatus) error {
+	entries, keep, grace, dryRun := collectedEntries(spec, status)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	used, err := usedHostnames(ctx, c, nil, "")
+	if err != nil {
+		return err
+	}
+
+	swept, remove := sweep(entries, used, metav1.NewTime(Clock.Now()), grace, dryRun)
+	kept, err := deleteEntries(ctx, p, remove)
+	status.ManagedEntries = append(append(keep, swept...), kept...)
+
+	return err
+}
+
+// releaseEntries deletes from FreeIPA the entries of the status of a deleted
+// issuer that no CertificateRequest nor Certificate of another issuer uses,
+// without grace period. Entries garbage collection would keep are left in
+// FreeIPA, as well as every entry in dry run mode.
+func releaseEntries(ctx context.Context, c client.Client, p *provisioners.FreeIPAPKI, spec *api.IssuerSpec, status *api.IssuerStatus, ref cmmeta.ObjectReference, namespace string) error {
+	entries, _, _, dryRun := collectedEntries(spec, status)
+	if len(entries) == 0 || dryRun {
+		status.ManagedEntries = nil
+		return nil
+	}
+
+	used, err := usedHostnames(ctx, c, &ref, namespace)
+	if err != nil {
+		return err
+	}
+
+	var remove []api.ManagedEntry
+	for _, entry := range entries {
+		if !used[entryHostname(entry)] {
+			remove = append(remove, entry)
+		}
+	}
+	sortForDeletion(remove)
+
+	kept, err := deleteEntries(ctx, p, remove)
+	status.ManagedEntries = kept
+
+	return err
+}
+
+// collectedEntries splits the entries of the status between the ones garbage
+// collection looks at and the ones it keeps, and returns its grace period and
+// dry run mode.
+func collectedEntries(spec *api.IssuerSpec, status *api.IssuerStatus) ([]api.ManagedEntry, []api.ManagedEntry, time.Duration, bool) {
+	gc := spec.GarbageCollection
+	if gc != nil && gc.Enabled {
+		grace := defaultGracePeriod
+		if gc.GracePeriod != nil {
+			grace = gc.GracePeriod.Duration
+		}
+
+		return status.ManagedEntries, nil, grace, gc.DryRun
+	}
+
+	var entries, keep []api.ManagedEntry
+	for _, entry := range status.ManagedEntries {
+		if entry.Kind == api.ManagedEntryPrincipalAlias {
+			entries = append(entries, entry)
+		} else {
+			keep = append(keep, entry)
+		}
+	}
+
+	return entries, keep, 0, false
+}
+
+// deleteEntries deletes the entries from FreeIPA, and returns the ones it
+// failed to delete with the last error. Entries that changed in FreeIPA are
+// forgotten.
+func deleteEntries(ctx context.Context, p *provisioners.FreeIPAPKI, remove []api.ManagedEntry) ([]api.ManagedEntry, error) {
+	log := log.FromContext(ctx)
+
+	var keep []api.ManagedEntry
+	var deleteErr error
+	for _, entry := range remove {
+		err := p.Delete(ctx, entry)
+
+		var notManaged *provisioners.NotManagedError
+		if errors.As(err, &notManaged) {
+			log.Info("entry changed in FreeIPA, forgetting it", "kind", entry.Kind, "name", entry.Name, "reason", err.Error())
+			continue
+		}
+		if err != nil {
+			log.Error(err, "failed to delete unused entry", "kind", entry.Kind, "name", entry.Name)
+			keep = append(keep, entry)
+			deleteErr = err
+			continue
+		}
+
+		log.Info("deleted unused entry", "kind", entry.Kind, "name", entry.Name)
+	}
+
+	return keep, deleteErr
+}
+
+// sweep records since when the entries are unused, and splits them between
+// the ones to keep and the ones unused for longer than the grace period.
+// Principal aliases and DNS records come first in the entries to delete, then
+// services, then hosts.
+func sweep(entries []api.ManagedEntry, used map[string]bool, now metav1.Time, grace time.Duration, dryRun bool) ([]api.ManagedEntry, []api.ManagedEntry) {
+	var keep, remove []api.ManagedEntry
+	for _, entry := range entries {
+		switch {
+		case used[entryHostname(entry)]:
+			entry.UnusedSince = nil
+			entry.PendingDeletion = false
+		case entry.UnusedSince == nil:
+			entry.UnusedSince = &now
+		case now.Sub(entry.UnusedSince.Time) >= grace:
+			if !dryRun {
+				remove = append(remove, entry)
+				continue
+			}
+			entry.PendingDeletion = true
+		}
+
+		keep = append(keep, entry)
+	}
+
+	sortForDeletion(remove)
+
+	return keep, remove
+}
+
+// sortForDeletion sorts the entries to delete, so that principals are deleted
+// before the entries holding them.
+func sortForDeletion(entries []api.ManagedEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return deletionOrder[entries[i].Kind] < deletionOrder[entries[j].Kind]
+	})
+}
+
+// deletionOrder is the order in which the kinds of entries are deleted.
+var deletionOrder = map[api.ManagedEntryKind]int{
+	api.ManagedEntryPrincipalAlias: 0,
+	api.ManagedEntryDNSRecord:      0,
+	api.ManagedEntryService:        1,
+	api.ManagedEntryHost:           2,
+}
+
+// entryHostname returns the host name of a host or a DNS record, or of the
+// principal of a service or an alias.
+func entryHostname(entry api.ManagedEntry) string {
+	if entry.Kind == api.ManagedEntryHost || entry.Kind == api.ManagedEntryDNSRecord {
+		return entry.Name
+	}
+
+	host := entry.Name
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[i+1:]
+	}
+	if i := strings.Index(host, "@"); i >= 0 {
+		host = host[:i]
+	}
+
+	return host
+}
+
+// usedHostnames returns the DNS names of the CertificateRequests and the
+// Certificates of every namespace, whatever their issuer: the hosts and
+// services an issuer created may hold the certificates of another one. The
+// ones of the deleted issuer, if any, in the namespace of an Issuer, do not
+// count.
+func usedHostnames(ctx context.Context, c client.Client, deleted *cmmeta.ObjectReference, namespace string) (map[string]bool, error) {
+	ignored := func(issuerRef cmmeta.ObjectReference, issuerNamespace string) bool {
+		return deleted != nil && referencesIssuer(issuerRef, *deleted) &&
+			(deleted.Kind == "ClusterIssuer" || issuerNamespace == namespace)
+	}
+
+	used := map[string]bool{}
+	add := func(names ...string) {
+		for _, name := range names {
+			if name != "" {
+				used[name] = true
+			}
+		}
+	}
+
+	requests := &certmanager.CertificateRequestList{}
+	if err := c.List(ctx, requests); err != nil {
+		return nil, err
+	}
+	for _, cr := range requests.Items {
+		if ignored(cr.Spec.IssuerRef, cr.Namespace) {
+			continue
+		}
+		csr, err := pki.DecodeX509CertificateRequestBytes(cr.Spec.Request)
+		if err != nil {
+			continue
+		}
+		add(csr.Subject.CommonName)
+		add(csr.DNSNames...)
+	}
+
+	certificates := &certmanager.CertificateList{}
+	if err := c.List(ctx, certificates); err != nil {
+		return nil, err
+	}
+	for _, cert := range certificates.Items {
+		if ignored(cert.Spec.IssuerRef, cert.Namespace) {
+			continue
+		}
+		add(cert.Spec.CommonName)
+		add(cert.Spec.DNSNames...)
+	}
+
+	return used, nil
+}
+
+// referencesIssuer reports whether issuerRef is the issuer ref, cert-manager
+// defaulting an empty kind to Issuer.
+func referencesIssuer(issuerRef, ref cmmeta.ObjectReference) bool {
+	if issuerRef.Group != "" && issuerRef.Group != api.GroupVersion.Group {
+		return false
+	}
+
+	kind := issuerRef.Kind
+	if kind == "" {
+		kind = "Issuer"
+	}
+
+	return kind == ref.Kind && issuerRef.Name == ref.Name
+}
@@ -0,0 +1,285 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+// newCertificateOf returns a Certificate of the DNS name, signed by the
+// issuer of the kind.
+func newCertificateOf(name, namespace, kind, issuer, dnsName string) *certmanager.Certificate {
+	return &certmanager.Certificate{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: certmanager.CertificateSpec{
+			DNSNames:   []string{dnsName},
+			SecretName: name,
+			IssuerRef:  cmmeta.ObjectReference{Name: issuer, Kind: kind, Group: api.GroupVersion.Group},
+		},
+	}
+}
+
+func Test_sweep(t *testing.T) {
+	now := metav1.NewTime(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	recently := metav1.NewTime(now.Add(-time.Hour))
+	longAgo := metav1.NewTime(now.Add(-48 * time.Hour))
+
+	host := api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "old.example.test", UnusedSince: &longAgo}
+	service := api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/old.example.test@EXAMPLE.TEST", UnusedSince: &longAgo}
+	alias := api.ManagedEntry{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/old.example.test", Principal: "HTTP/www.example.test", UnusedSince: &longAgo}
+	entries := []api.ManagedEntry{
+		{Kind: api.ManagedEntryHost, Name: "www.example.test", UnusedSince: &recently},
+		{Kind: api.ManagedEntryHost, Name: "new.example.test"},
+		{Kind: api.ManagedEntryHost, Name: "recent.example.test", UnusedSince: &recently},
+		host,
+		service,
+		alias,
+	}
+	used := map[string]bool{"www.example.test": true}
+
+	tests := []struct {
+		name       string
+		dryRun     bool
+		wantKeep   []api.ManagedEntry
+		wantRemove []api.ManagedEntry
+	}{
+		{
+			name: "delete",
+			wantKeep: []api.ManagedEntry{
+				{Kind: api.ManagedEntryHost, Name: "www.example.test"},
+				{Kind: api.ManagedEntryHost, Name: "new.example.test", UnusedSince: &now},
+				{Kind: api.ManagedEntryHost, Name: "recent.example.test", UnusedSince: &recently},
+			},
+			wantRemove: []api.ManagedEntry{alias, service, host},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			wantKeep: []api.ManagedEntry{
+				{Kind: api.ManagedEntryHost, Name: "www.example.test"},
+				{Kind: api.ManagedEntryHost, Name: "new.example.test", UnusedSince: &now},
+				{Kind: api.ManagedEntryHost, Name: "recent.example.test", UnusedSince: &recently},
+				{Kind: api.ManagedEntryHost, Name: "old.example.test", UnusedSince: &longAgo, PendingDeletion: true},
+				{Kind: api.ManagedEntryService, Name: "HTTP/old.example.test@EXAMPLE.TEST", UnusedSince: &longAgo, PendingDeletion: true},
+				{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/old.example.test", Principal: "HTTP/www.example.test", UnusedSince: &longAgo, PendingDeletion: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep, remove := sweep(entries, used, now, 24*time.Hour, tt.dryRun)
+			if !reflect.DeepEqual(keep, tt.wantKeep) {
+				t.Errorf("sweep() keep = %v, want %v", keep, tt.wantKeep)
+			}
+			if !reflect.DeepEqual(remove, tt.wantRemove) {
+				t.Errorf("sweep() remove = %v, want %v", remove, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func Test_addEntries(t *testing.T) {
+	since := metav1.NewTime(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	record := func(target string) api.ManagedEntry {
+		return api.ManagedEntry{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: target}
+	}
+	unused := record("10.0.0.1")
+	unused.UnusedSince = &since
+	unused.PendingDeletion = true
+	list := []api.ManagedEntry{
+		unused,
+		{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/www.example.test"},
+	}
+
+	got := addEntries(list, []api.ManagedEntry{
+		record("10.0.0.1"),
+		record("10.0.0.2"),
+		{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/other.example.test"},
+	})
+
+	want := []api.ManagedEntry{
+		record("10.0.0.1"),
+		{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/www.example.test"},
+		record("10.0.0.2"),
+		{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/other.example.test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("addEntries() = %v, want %v", got, want)
+	}
+}
+
+func Test_entryHostname(t *testing.T) {
+	tests := []struct {
+		entry api.ManagedEntry
+		want  string
+	}{
+		{api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "www.example.test"}, "www.example.test"},
+		{api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/www.example.test"}, "www.example.test"},
+		{api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/www.example.test@EXAMPLE.TEST"}, "www.example.test"},
+		{api.ManagedEntry{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/www.example.test"}, "api.example.test"},
+		{api.ManagedEntry{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.1"}, "www.example.test"},
+	}
+	for _, tt := range tests {
+		if got := entryHostname(tt.entry); got != tt.want {
+			t.Errorf("entryHostname(%v) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func Test_usedHostnames(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(newScheme(t)).WithObjects(
+		newCertificateOf("mine", "default", "Issuer", "ipa", "mine.example.test"),
+		newCertificateOf("other-issuer", "default", "Issuer", "other", "other-issuer.example.test"),
+		newCertificateOf("other-namespace", "other", "Issuer", "ipa", "other-namespace.example.test"),
+		newCertificateOf("cluster-issuer", "other", "ClusterIssuer", "ipa", "cluster-issuer.example.test"),
+	).Build()
+
+	tests := []struct {
+		name    string
+		deleted *cmmeta.ObjectReference
+		want    []string
+	}{
+		{
+			name: "every issuer",
+			want: []string{"cluster-issuer.example.test", "mine.example.test", "other-issuer.example.test", "other-namespace.example.test"},
+		},
+		{
+			name:    "deleted Issuer",
+			deleted: &cmmeta.ObjectReference{Kind: "Issuer", Name: "ipa"},
+			want:    []string{"cluster-issuer.example.test", "other-issuer.example.test", "other-namespace.example.test"},
+		},
+		{
+			name:    "deleted ClusterIssuer",
+			deleted: &cmmeta.ObjectReference{Kind: "ClusterIssuer", Name: "ipa"},
+			want:    []string{"mine.example.test", "other-issuer.example.test", "other-namespace.example.test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used, err := usedHostnames(context.Background(), c, tt.deleted, "default")
+			if err != nil {
+				t.Fatalf("usedHostnames() error = %v", err)
+			}
+			var got []string
+			for name := range used {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("usedHostnames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssuerReconciler_finalize(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	host := newFakeIPA(t, map[string]fakeMethod{
+		"host_show": func(options map[string]interface{}) interface{} {
+			return map[string]interface{}{"result": map[string]interface{}{
+				"fqdn":        options["fqdn"],
+				"description": []string{"Managed by freeipa-issuer cluster=default namespace=default certificaterequest=www"},
+			}}
+		},
+		"host_del": func(options map[string]interface{}) interface{} {
+			fqdns, _ := options["fqdn"].([]interface{})
+			mu.Lock()
+			for _, fqdn := range fqdns {
+				deleted = append(deleted, fqdn.(string))
+			}
+			mu.Unlock()
+			return map[string]interface{}{"result": map[string]interface{}{}}
+		},
+	})
+
+	tests := []struct {
+		name        string
+		secret      bool
+		wantDeleted []string
+	}{
+		{
+			name:        "unused hosts",
+			secret:      true,
+			wantDeleted: []string{"mine.example.test", "unused.example.test"},
+		},
+		{
+			name: "credentials gone",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			deleted = nil
+			mu.Unlock()
+
+			now := metav1.Now()
+			issuer := &api.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "ipa", Namespace: "default", Generation: 1, DeletionTimestamp: &now, Finalizers: []string{issuerFinalizer}},
+				Spec: api.IssuerSpec{
+					Host:              host,
+					Insecure:          true,
+					Ca:                "ipa",
+					User:              &api.SecretKeySelector{SecretReference: corev1.SecretReference{Name: "ipa"}, Key: "user"},
+					Password:          &api.SecretKeySelector{SecretReference: corev1.SecretReference{Name: "ipa"}, Key: "password"},
+					GarbageCollection: &api.GarbageCollectionSpec{Enabled: true},
+				},
+				Status: api.IssuerStatus{ManagedEntries: []api.ManagedEntry{
+					{Kind: api.ManagedEntryHost, Name: "unused.example.test"},
+					{Kind: api.ManagedEntryHost, Name: "mine.example.test"},
+					{Kind: api.ManagedEntryHost, Name: "used.example.test"},
+				}},
+			}
+			objects := []client.Object{
+				issuer,
+				newCertificateOf("mine", "default", "Issuer", "ipa", "mine.example.test"),
+				newCertificateOf("used", "default", "Issuer", "other", "used.example.test"),
+			}
+			if tt.secret {
+				objects = append(objects, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "ipa", Namespace: "default"},
+					Data:       map[string][]byte{"user": []byte("admin"), "password": []byte("secret")},
+				})
+			}
+			c := fake.NewClientBuilder().WithScheme(newScheme(t)).WithObjects(objects...).Build()
+			r := &IssuerReconciler{Client: c, Registry: provisioners.NewRegistry(provisioners.DefaultClusterName)}
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "ipa", Namespace: "default"}}
+			if _, err := r.Reconcile(context.Background(), req); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+
+			mu.Lock()
+			got := append([]string(nil), deleted...)
+			mu.Unlock()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantDeleted) {
+				t.Errorf("deleted hosts = %v, want %v", got, tt.wantDeleted)
+			}
+			// The deleted Issuer is gone once it has no finalizer.
+			iss := &api.Issuer{}
+			err := c.Get(context.Background(), req.NamespacedName, iss)
+			if !apierrors.IsNotFound(err) && (err != nil || controllerutil.ContainsFinalizer(iss, issuerFinalizer)) {
+				t.Errorf("Reconcile() kept the finalizer, get error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+const (
+	// revocationFinalizer keeps a CertificateRequest until its certificate is
+	// revoked as the revocation policy of its issuer says.
+	revocationFinalizer = "freeipa.org/revocation"
+
+	// revokedAnnotation marks CertificateRequests whose certificate is revoked.
+	revokedAnnotation = "freeipa.org/revoked"
+)
+
+// finalize revokes the certificate of a deleted CertificateRequest when the
+// revocation policy of its issuer says so, then removes the finalizer.
+func (r *CertificateRequestReconciler) finalize(ctx context.Context, cr *certmanager.CertificateRequest) (reconcile.Result, error) {
+	if !controllerutil.ContainsFinalizer(cr, revocationFinalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	// Without a certificate to revoke, the issuer is not needed.
+	if revocable(cr) {
+		if err := r.revokeDeleted(ctx, cr); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	controllerutil.RemoveFinalizer(cr, revocationFinalizer)
+
+	return reconcile.Result{}, r.Client.Update(ctx, cr)
+}
+
+// revokeDeleted revokes the certificate of a deleted CertificateRequest when
+// the revocation policy of its issuer says so.
+func (r *CertificateRequestReconciler) revokeDeleted(ctx context.Context, cr *certmanager.CertificateRequest) error {
+	log := log.FromContext(ctx).WithValues("certificaterequest", client.ObjectKeyFromObject(cr))
+
+	issNamespaceName := issuerName(cr)
+
+	iss, spec, _, err := r.getIssuer(ctx, cr)
+	if apierrors.IsNotFound(err) {
+		log.Info("issuer is gone, certificate is not revoked", "issuer", issNamespaceName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !iss.GetDeletionTimestamp().IsZero() {
+		log.Info("issuer is being deleted, certificate is not revoked", "issuer", issNamespaceName)
+		return nil
+	}
+
+	p, err := r.loadProvisioner(ctx, cr, iss, spec)
+	if err != nil {
+		log.Error(err, "failed to load provisioner", "issuer", issNamespaceName)
+		return err
+	}
+
+	revoke := false
+	switch p.RevocationPolicy() {
+	case api.RevocationPolicyOnDelete:
+		revoke = true
+	case api.RevocationPolicyOnSupersede:
+		revisions, err := r.certificateRevisions(ctx, cr)
+		if err != nil {
+			return err
+		}
+		for _, other := range revisions {
+			if revision(&other) > revision(cr) && len(other.Status.Certificate) > 0 {
+				revoke = true
+			}
+		}
+	}
+	if !revoke {
+		return nil
+	}
+
+	if err := revokeCertificate(ctx, p, cr); err != nil {
+		log.Error(err, "failed to revoke certificate")
+		return err
+	}
+
+	return nil
+}
+
+// revokeSuperseded revokes the certificates of the older CertificateRequests
+// of the Certificate of cr, when the revocation policy of the issuer is
+// OnSupersede.
+func (r *CertificateRequestReconciler) revokeSuperseded(ctx context.Context, cr *certmanager.CertificateRequest) error {
+	if !controllerutil.ContainsFinalizer(cr, revocationFinalizer) {
+		return nil
+	}
+
+	iss, spec, _, err := r.getIssuer(ctx, cr)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !iss.GetDeletionTimestamp().IsZero() {
+		return nil
+	}
+	p, err := r.loadProvisioner(ctx, cr, iss, spec)
+	if err != nil {
+		return err
+	}
+	if p.RevocationPolicy() != api.RevocationPolicyOnSupersede {
+		return nil
+	}
+
+	revisions, err := r.certificateRevisions(ctx, cr)
+	if err != nil {
+		return err
+	}
+
+	for i := range revisions {
+		other := &revisions[i]
+		if revision(other) >= revision(cr) || other.Annotations[revokedAnnotation] == "true" {
+			continue
+		}
+
+		if err := revokeCertificate(ctx, p, other); err != nil {
+			return err
+		}
+		if len(other.Status.Certificate) > 0 {
+			if err := r.Client.Update(ctx, other); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// revocable reports whether the CertificateRequest has a certificate which
+// is not revoked yet.
+func revocable(cr *certmanager.CertificateRequest) bool {
+	return len(cr.Status.Certificate) > 0 && cr.Annotations[revokedAnnotation] != "true"
+}
+
+// revokeCertificate revokes the certificate of the CertificateRequest, unless
+// it has none or it is already revoked, and marks it as revoked.
+func revokeCertificate(ctx context.Context, p *provisioners.FreeIPAPKI, cr *certmanager.CertificateRequest) error {
+	if !revocable(cr) {
+		return nil
+	}
+
+	if err := p.Revoke(ctx, cr.Status.Certificate); err != nil {
+		return err
+	}
+
+	metav1.SetMetaDataAnnotation(&cr.ObjectMeta, revokedAnnotation, "true")
+
+	return nil
+}
+
+// certificateRevisions returns the other CertificateRequests of the
+// Certificate of cr signed by the same issuer.
+func (r *CertificateRequestReconciler) certificateRevisions(ctx context.Context, cr *certmanager.CertificateRequest) ([]certmanager.CertificateRequest, error) {
+	name, ok := cr.Annotations[certmanager.CertificateNameKey]
+	if !ok {
+		return nil, nil
+	}
+
+	list := &certmanager.CertificateRequestList{}
+	if err := r.Client.List(ctx, list, client.InNamespace(cr.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var revisions []certmanager.CertificateRequest
+	for _, other := range list.Items {
+		if other.Name == cr.Name || other.Annotations[certmanager.CertificateNameKey] != name || other.Spec.IssuerRef != cr.Spec.IssuerRef {
+			continue
+		}
+		revisions = append(revisions, other)
+	}
+
+	return revisions, nil
+}
+
+// revision returns the revision of the Certificate the CertificateRequest
+// was created for.
+func revision(cr *certmanager.CertificateRequest) int {
+	rev, _ := strconv.Atoi(cr.Annotations[certmanager.CertificateRequestRevisionAnnotationKey])
+	return rev
+}
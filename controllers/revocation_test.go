@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
+)
+
+// newCertificate returns a PEM encoded self-signed certificate with the
+// serial number.
+func newCertificate(t *testing.T, serial int64) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "www.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newRevision returns a CertificateRequest of revision of the Certificate,
+// signed by the issuer with a certificate of the serial number, none when it
+// is 0.
+func newRevision(t *testing.T, name, certificate string, revision int, issuer string, serial int64) *certmanager.CertificateRequest {
+	t.Helper()
+
+	cr := &certmanager.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				certmanager.CertificateNameKey:                      certificate,
+				certmanager.CertificateRequestRevisionAnnotationKey: strconv.Itoa(revision),
+			},
+			Finalizers: []string{revocationFinalizer},
+		},
+		Spec: certmanager.CertificateRequestSpec{
+			IssuerRef: cmmeta.ObjectReference{Name: issuer, Kind: "Issuer", Group: api.GroupVersion.Group},
+		},
+	}
+	if serial != 0 {
+		cr.Status.Certificate = newCertificate(t, serial)
+	}
+
+	return cr
+}
+
+// revocationFixture is a reconciler whose issuer "ipa" has the revocation
+// policy, with the serial numbers FreeIPA revoked.
+type revocationFixture struct {
+	r *CertificateRequestReconciler
+
+	mu      sync.Mutex
+	revoked []int
+}
+
+func newRevocationFixture(t *testing.T, policy api.RevocationPolicy, objects ...client.Object) *revocationFixture {
+	t.Helper()
+
+	f := &revocationFixture{}
+	host := newFakeIPA(t, map[string]fakeMethod{
+		"cert_revoke": func(options map[string]interface{}) interface{} {
+			serial, _ := options["serial_number"].(float64)
+			f.mu.Lock()
+			f.revoked = append(f.revoked, int(serial))
+			f.mu.Unlock()
+			return map[string]interface{}{"result": map[string]interface{}{"revoked": true}}
+		},
+	})
+
+	issuerName := types.NamespacedName{Name: "ipa", Namespace: "default"}
+	issuer := &api.Issuer{
+		ObjectMeta: metav1.ObjectMeta{Name: issuerName.Name, Namespace: issuerName.Namespace, Generation: 1},
+		Spec: api.IssuerSpec{
+			Host:       host,
+			Insecure:   true,
+			Ca:         "ipa",
+			Revocation: &api.RevocationSpec{Policy: policy},
+		},
+	}
+
+	registry := provisioners.NewRegistry(provisioners.DefaultClusterName)
+	p, err := registry.New(issuerName, issuer.Spec.DeepCopy(), &provisioners.Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	registry.Store(issuerName, 1, p)
+	t.Cleanup(func() { registry.Delete(issuerName) })
+
+	c := fake.NewClientBuilder().WithScheme(newScheme(t)).WithObjects(append(objects, issuer)...).Build()
+	f.r = &CertificateRequestReconciler{Client: c, Registry: registry}
+
+	return f
+}
+
+// get returns the CertificateRequest of the fixture.
+func (f *revocationFixture) get(t *testing.T, name string) *certmanager.CertificateRequest {
+	t.Helper()
+
+	cr := &certmanager.CertificateRequest{}
+	if err := f.r.Client.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "default"}, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	return cr
+}
+
+// makeUnavailable removes the provisioner of the issuer, which can no longer
+// be built.
+func (f *revocationFixture) makeUnavailable(t *testing.T) {
+	t.Helper()
+
+	issuerName := types.NamespacedName{Name: "ipa", Namespace: "default"}
+	f.r.Registry.Delete(issuerName)
+
+	iss := &api.Issuer{}
+	if err := f.r.Client.Get(context.Background(), issuerName, iss); err != nil {
+		t.Fatal(err)
+	}
+	iss.Spec.Host = "127.0.0.1:1"
+	if err := f.r.Client.Update(context.Background(), iss); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deleteIssuer deletes the issuer, kept by its finalizer, and removes its
+// provisioner as the issuer controller does.
+func (f *revocationFixture) deleteIssuer(t *testing.T) {
+	t.Helper()
+
+	issuerName := types.NamespacedName{Name: "ipa", Namespace: "default"}
+	iss := &api.Issuer{}
+	if err := f.r.Client.Get(context.Background(), issuerName, iss); err != nil {
+		t.Fatal(err)
+	}
+	controllerutil.AddFinalizer(iss, issuerFinalizer)
+	if err := f.r.Client.Update(context.Background(), iss); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.r.Client.Delete(context.Background(), iss); err != nil {
+		t.Fatal(err)
+	}
+	f.r.Registry.Delete(issuerName)
+}
+
+// revokedSerials returns the sorted serial numbers FreeIPA revoked.
+func (f *revocationFixture) revokedSerials() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	revoked := append([]int(nil), f.revoked...)
+	sort.Ints(revoked)
+
+	return revoked
+}
+
+func Test_certificateRevisions(t *testing.T) {
+	other := newRevision(t, "www-other-ns", "www", 1, "ipa", 0)
+	other.Namespace = "other"
+	f := newRevocationFixture(t, api.RevocationPolicyOnSupersede,
+		newRevision(t, "www-1", "www", 1, "ipa", 0),
+		newRevision(t, "www-2", "www", 2, "ipa", 0),
+		newRevision(t, "www-3", "www", 3, "ipa", 0),
+		newRevision(t, "www-other-issuer", "www", 1, "other", 0),
+		newRevision(t, "api-1", "api", 1, "ipa", 0),
+		other,
+	)
+
+	revisions, err := f.r.certificateRevisions(context.Background(), f.get(t, "www-2"))
+	if err != nil {
+		t.Fatalf("certificateRevisions() error = %v", err)
+	}
+	var names []string
+	for _, cr := range revisions {
+		names = append(names, cr.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"www-1", "www-3"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("certificateRevisions() = %v, want %v", names, want)
+	}
+
+	orphan := newRevision(t, "orphan", "", 1, "ipa", 0)
+	delete(orphan.Annotations, certmanager.CertificateNameKey)
+	if revisions, err := f.r.certificateRevisions(context.Background(), orphan); err != nil || revisions != nil {
+		t.Errorf("certificateRevisions() without Certificate = %v, %v, want none", revisions, err)
+	}
+}
+
+func TestCertificateRequestReconciler_revokeSuperseded(t *testing.T) {
+	revoked := newRevision(t, "www-2", "www", 2, "ipa", 2)
+	revoked.Annotations[revokedAnnotation] = "true"
+
+	tests := []struct {
+		name        string
+		policy      api.RevocationPolicy
+		wantRevoked []int
+	}{
+		{
+			name:        "on supersede",
+			policy:      api.RevocationPolicyOnSupersede,
+			wantRevoked: []int{1},
+		},
+		{
+			name:   "on delete",
+			policy: api.RevocationPolicyOnDelete,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newRevocationFixture(t, tt.policy,
+				newRevision(t, "www-1", "www", 1, "ipa", 1),
+				revoked.DeepCopy(),
+				newRevision(t, "www-3", "www", 3, "ipa", 3),
+				newRevision(t, "www-4", "www", 4, "ipa", 4),
+				newRevision(t, "www-other-issuer", "www", 1, "other", 5),
+			)
+
+			if err := f.r.revokeSuperseded(context.Background(), f.get(t, "www-3")); err != nil {
+				t.Fatalf("revokeSuperseded() error = %v", err)
+			}
+
+			if got := f.revokedSerials(); !reflect.DeepEqual(got, tt.wantRevoked) {
+				t.Errorf("revoked serial numbers = %v, want %v", got, tt.wantRevoked)
+			}
+			if got := f.get(t, "www-1").Annotations[revokedAnnotation] == "true"; got != (len(tt.wantRevoked) > 0) {
+				t.Errorf("www-1 revoked annotation = %v, want %v", got, len(tt.wantRevoked) > 0)
+			}
+			for _, name := range []string{"www-4", "www-other-issuer"} {
+				if _, ok := f.get(t, name).Annotations[revokedAnnotation]; ok {
+					t.Errorf("%s marked as revoked", name)
+				}
+			}
+		})
+	}
+}
+
+func TestCertificateRequestReconciler_finalize(t *testing.T) {
+	revoked := newRevision(t, "www-1", "www", 1, "ipa", 1)
+	revoked.Annotations[revokedAnnotation] = "true"
+	orphan := newRevision(t, "www-1", "www", 1, "gone", 1)
+
+	tests := []struct {
+		name        string
+		policy      api.RevocationPolicy
+		cr          *certmanager.CertificateRequest
+		others      []client.Object
+		unavailable bool
+		deleting    bool
+		wantRevoked []int
+	}{
+		{
+			name:        "on delete",
+			policy:      api.RevocationPolicyOnDelete,
+			cr:          newRevision(t, "www-1", "www", 1, "ipa", 1),
+			wantRevoked: []int{1},
+		},
+		{
+			name:        "on delete without certificate",
+			policy:      api.RevocationPolicyOnDelete,
+			cr:          newRevision(t, "www-1", "www", 1, "ipa", 0),
+			unavailable: true,
+		},
+		{
+			name:        "on delete already revoked",
+			policy:      api.RevocationPolicyOnDelete,
+			cr:          revoked,
+			unavailable: true,
+		},
+		{
+			name:        "on supersede with a newer revision",
+			policy:      api.RevocationPolicyOnSupersede,
+			cr:          newRevision(t, "www-1", "www", 1, "ipa", 1),
+			others:      []client.Object{newRevision(t, "www-2", "www", 2, "ipa", 2)},
+			wantRevoked: []int{1},
+		},
+		{
+			name:   "on supersede with a newer revision not issued",
+			policy: api.RevocationPolicyOnSupersede,
+			cr:     newRevision(t, "www-1", "www", 1, "ipa", 1),
+			others: []client.Object{newRevision(t, "www-2", "www", 2, "ipa", 0)},
+		},
+		{
+			name:   "on supersede with a newer revision of another issuer",
+			policy: api.RevocationPolicyOnSupersede,
+			cr:     newRevision(t, "www-1", "www", 1, "ipa", 1),
+			others: []client.Object{newRevision(t, "www-2", "www", 2, "other", 2)},
+		},
+		{
+			name:     "issuer being deleted",
+			policy:   api.RevocationPolicyOnDelete,
+			cr:       newRevision(t, "www-1", "www", 1, "ipa", 1),
+			deleting: true,
+		},
+		{
+			name:   "issuer gone",
+			policy: api.RevocationPolicyOnDelete,
+			cr:     orphan,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := tt.cr.DeepCopy()
+			now := metav1.Now()
+			cr.DeletionTimestamp = &now
+			f := newRevocationFixture(t, tt.policy, append(tt.others, cr)...)
+			if tt.unavailable {
+				f.makeUnavailable(t)
+			}
+			if tt.deleting {
+				f.deleteIssuer(t)
+			}
+
+			if _, err := f.r.finalize(context.Background(), f.get(t, cr.Name)); err != nil {
+				t.Fatalf("finalize() error = %v", err)
+			}
+
+			if got := f.revokedSerials(); !reflect.DeepEqual(got, tt.wantRevoked) {
+				t.Errorf("revoked serial numbers = %v, want %v", got, tt.wantRevoked)
+			}
+			if tt.deleting && f.r.Registry.Len() != 0 {
+				t.Error("finalize() built the provisioner of the deleted issuer")
+			}
+			// The deleted CertificateRequest is gone once it has no finalizer.
+			got := &certmanager.CertificateRequest{}
+			err := f.r.Client.Get(context.Background(), client.ObjectKeyFromObject(cr), got)
+			if !apierrors.IsNotFound(err) && (err != nil || controllerutil.ContainsFinalizer(got, revocationFinalizer)) {
+				t.Errorf("finalize() kept the revocation finalizer, get error = %v", err)
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -64,45 +65,174 @@ func SetIssuerCondition(ctx context.Context, status *api.IssuerStatus, condition
 	status.Conditions = append(status.Conditions, c)
 }
 
-func initSecrets(ctx context.Context, client client.Client, req ctrl.Request, user, pw api.SecretKeySelector) ([]byte, []byte, error) {
+// initSecrets reads the credentials and the CA bundle referenced by the
+// issuer spec. A keytab takes precedence over a client certificate, which
+// takes precedence over the user and password.
+func initSecrets(ctx context.Context, client client.Client, req ctrl.Request, spec *api.IssuerSpec) (*provisioners.Credentials, error) {
+	creds := &provisioners.Credentials{
+		CABundle: spec.CABundle,
+	}
+
+	if ref := spec.CABundleRef; ref != nil {
+		var bundle []byte
+		var err error
+		switch {
+		case ref.Secret != nil:
+			bundle, err = secretKey(ctx, client, req, *ref.Secret)
+		case ref.ConfigMap != nil:
+			bundle, err = configMapKey(ctx, client, req, *ref.ConfigMap)
+		default:
+			err = fmt.Errorf("caBundleRef must select a secret or a configMap")
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	userSecret := corev1.Secret{}
-	userdNamespace := req.Namespace
-	if user.Namespace != "" {
-		userdNamespace = user.Namespace
+		creds.CABundle = append(append([]byte{}, creds.CABundle...), bundle...)
 	}
-	userSecretNamespaceName := types.NamespacedName{
-		Namespace: userdNamespace,
-		Name:      user.Name,
+
+	if spec.Keytab != nil {
+		keytab, err := secretKey(ctx, client, req, *spec.Keytab)
+		if err != nil {
+			return nil, err
+		}
+		creds.Keytab = keytab
+
+		if spec.User != nil {
+			user, err := secretKey(ctx, client, req, *spec.User)
+			if err != nil {
+				return nil, err
+			}
+			creds.User = string(user)
+		}
+
+		return creds, nil
 	}
 
-	if err := client.Get(ctx, userSecretNamespaceName, &userSecret); err != nil {
-		return nil, nil, err
+	if ref := spec.ClientCertificate; ref != nil {
+		cert, err := secretKey(ctx, client, req, api.SecretKeySelector{SecretReference: *ref, Key: corev1.TLSCertKey})
+		if err != nil {
+			return nil, err
+		}
+		creds.ClientCert = cert
+
+		key, err := secretKey(ctx, client, req, api.SecretKeySelector{SecretReference: *ref, Key: corev1.TLSPrivateKeyKey})
+		if err != nil {
+			return nil, err
+		}
+		creds.ClientKey = key
+
+		if spec.User != nil {
+			user, err := secretKey(ctx, client, req, *spec.User)
+			if err != nil {
+				return nil, err
+			}
+			creds.User = string(user)
+		}
+
+		return creds, nil
 	}
 
-	userData, ok := userSecret.Data[user.Key]
-	if !ok {
-		return nil, nil, fmt.Errorf("secret %s does not contain key %q", userSecret.Name, user.Key)
+	if spec.User == nil || spec.Password == nil {
+		return nil, fmt.Errorf("either a keytab, a client certificate or a user and a password must be set")
+	}
+
+	user, err := secretKey(ctx, client, req, *spec.User)
+	if err != nil {
+		return nil, err
 	}
+	creds.User = string(user)
 
-	passwordSecret := corev1.Secret{}
-	passwordNamespace := req.Namespace
-	if pw.Namespace != "" {
-		passwordNamespace = pw.Namespace
+	password, err := secretKey(ctx, client, req, *spec.Password)
+	if err != nil {
+		return nil, err
 	}
-	passwordSecretNamespaceName := types.NamespacedName{
-		Namespace: passwordNamespace,
-		Name:      pw.Name,
+	creds.Password = string(password)
+
+	return creds, nil
+}
+
+// secretKey returns the data of the selected secret key. The secret
+// defaults to the namespace of the request.
+func secretKey(ctx context.Context, client client.Client, req ctrl.Request, selector api.SecretKeySelector) ([]byte, error) {
+	secret := corev1.Secret{}
+	namespace := req.Namespace
+	if selector.Namespace != "" {
+		namespace = selector.Namespace
+	}
+	secretNamespaceName := types.NamespacedName{
+		Namespace: namespace,
+		Name:      selector.Name,
 	}
 
-	if err := client.Get(ctx, passwordSecretNamespaceName, &passwordSecret); err != nil {
-		return nil, nil, err
+	if err := client.Get(ctx, secretNamespaceName, &secret); err != nil {
+		return nil, err
 	}
 
-	passwordData, ok := passwordSecret.Data[pw.Key]
+	data, ok := secret.Data[selector.Key]
 	if !ok {
-		return nil, nil, fmt.Errorf("secret %s does not contain key %q", passwordSecret.Name, pw.Key)
+		return nil, fmt.Errorf("secret %s does not contain key %q", secret.Name, selector.Key)
+	}
+
+	return data, nil
+}
+
+// configMapKey returns the data of the selected ConfigMap key. The ConfigMap
+// defaults to the namespace of the request.
+func configMapKey(ctx context.Context, client client.Client, req ctrl.Request, selector api.ConfigMapKeySelector) ([]byte, error) {
+	configMap := corev1.ConfigMap{}
+	namespace := req.Namespace
+	if selector.Namespace != "" {
+		namespace = selector.Namespace
+	}
+	configMapNamespaceName := types.NamespacedName{
+		Namespace: namespace,
+		Name:      selector.Name,
+	}
+
+	if err := client.Get(ctx, configMapNamespaceName, &configMap); err != nil {
+		return nil, err
+	}
+
+	if data, ok := configMap.Data[selector.Key]; ok {
+		return []byte(data), nil
+	}
+	if data, ok := configMap.BinaryData[selector.Key]; ok {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("configmap %s does not contain key %q", configMap.Name, selector.Key)
+}
+
+// referencesObject reports whether the issuer spec references obj, a Secret
+// or a ConfigMap read by initSecrets. References default to the namespace of
+// the issuer.
+func referencesObject(spec *api.IssuerSpec, namespace string, obj client.Object) bool {
+	matches := func(name, ns string) bool {
+		if ns == "" {
+			ns = namespace
+		}
+		return name == obj.GetName() && ns == obj.GetNamespace()
+	}
+
+	switch obj.(type) {
+	case *corev1.Secret:
+		for _, selector := range []*api.SecretKeySelector{spec.User, spec.Password, spec.Keytab} {
+			if selector != nil && matches(selector.Name, selector.Namespace) {
+				return true
+			}
+		}
+		if ref := spec.ClientCertificate; ref != nil && matches(ref.Name, ref.Namespace) {
+			return true
+		}
+		if ref := spec.CABundleRef; ref != nil && ref.Secret != nil && matches(ref.Secret.Name, ref.Secret.Namespace) {
+			return true
+		}
+	case *corev1.ConfigMap:
+		if ref := spec.CABundleRef; ref != nil && ref.ConfigMap != nil && matches(ref.ConfigMap.Name, ref.ConfigMap.Namespace) {
+			return true
+		}
 	}
 
-	return userData, passwordData, nil
+	return false
 }
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+)
+
+func Test_referencesObject(t *testing.T) {
+	spec := &api.IssuerSpec{
+		User:     &api.SecretKeySelector{SecretReference: corev1.SecretReference{Name: "freeipa-auth"}, Key: "user"},
+		Password: &api.SecretKeySelector{SecretReference: corev1.SecretReference{Name: "freeipa-auth"}, Key: "password"},
+		CABundleRef: &api.CABundleReference{
+			ConfigMap: &api.ConfigMapKeySelector{Name: "ipa-ca", Namespace: "shared", Key: "ca.crt"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		obj  client.Object
+		want bool
+	}{
+		{
+			name: "auth secret",
+			obj:  &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "freeipa-auth", Namespace: "default"}},
+			want: true,
+		},
+		{
+			name: "auth secret in another namespace",
+			obj:  &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "freeipa-auth", Namespace: "other"}},
+		},
+		{
+			name: "CA configmap",
+			obj:  &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "ipa-ca", Namespace: "shared"}},
+			want: true,
+		},
+		{
+			name: "secret named like the CA configmap",
+			obj:  &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ipa-ca", Namespace: "shared"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := referencesObject(spec, "default", tt.obj); got != tt.want {
+				t.Errorf("referencesObject() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -32,6 +33,7 @@ import (
 
 	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
 	"github.com/guilhem/freeipa-issuer/controllers"
+	provisioners "github.com/guilhem/freeipa-issuer/provisionners"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -55,12 +57,18 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var disableApprovedCheck bool
+	var issuerCheckInterval time.Duration
+	var clusterName string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&disableApprovedCheck, "disable-approved-check", false,
 		"Disables waiting for CertificateRequests to have an approved condition before signing.")
+	flag.DurationVar(&issuerCheckInterval, "issuer-check-interval", 5*time.Minute,
+		"Interval between two checks of the FreeIPA setup of an issuer. 0 disables the periodic checks.")
+	flag.StringVar(&clusterName, "cluster-name", provisioners.DefaultClusterName,
+		"Name of the cluster in the description of the FreeIPA hosts created by the issuers.")
 	flag.Parse()
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -75,9 +83,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The provisioners are shared by the controllers, and closed when the
+	// manager stops.
+	registry := provisioners.NewRegistry(clusterName)
+	if err := mgr.Add(registry); err != nil {
+		setupLog.Error(err, "unable to add provisioner registry")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.CertificateRequestReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Registry: registry,
 
 		Clock:                  clock.RealClock{},
 		CheckApprovedCondition: !disableApprovedCheck,
@@ -87,15 +104,21 @@ func main() {
 	}
 
 	if err = (&controllers.IssuerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Registry: registry,
+
+		CheckInterval: issuerCheckInterval,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Issuer")
 		os.Exit(1)
 	}
 	if err = (&controllers.ClusterIssuerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Registry: registry,
+
+		CheckInterval: issuerCheckInterval,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ClusterIssuer")
 		os.Exit(1)
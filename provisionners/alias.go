@@ -0,0 +1,69 @@
+package provisioners
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+)
+
+// addPrincipalAliases adds to a service or host principal the aliases of the
+// same service for other hosts, and returns the aliases it added. Aliases the
+// principal already has are skipped.
+func addPrincipalAliases(client *freeipa.Client, p principal, hosts []string) ([]string, error) {
+	var added []string
+	for _, host := range hosts {
+		alias := p.withInstance(host).String()
+
+		var err error
+		if p.isHost() {
+			_, err = client.HostAddPrincipal(&freeipa.HostAddPrincipalArgs{
+				Fqdn:             p.instance,
+				Krbprincipalname: []string{alias},
+			}, &freeipa.HostAddPrincipalOptionalArgs{})
+		} else {
+			_, err = client.ServiceAddPrincipal(&freeipa.ServiceAddPrincipalArgs{
+				Krbcanonicalname: p.String(),
+				Krbprincipalname: []string{alias},
+			}, &freeipa.ServiceAddPrincipalOptionalArgs{})
+		}
+		if ipaE, ok := err.(*freeipa.Error); ok && (ipaE.Code == freeipa.EmptyModlistCode || ipaE.Code == freeipa.AlreadyActiveCode) {
+			continue
+		}
+		if err != nil {
+			return added, fmt.Errorf("fail adding principal alias %s to %s: %w", alias, p, err)
+		}
+
+		added = append(added, alias)
+	}
+
+	return added, nil
+}
+
+// removePrincipalAlias removes an alias from a service or host principal.
+// Aliases or principals already gone are ignored.
+func removePrincipalAlias(client *freeipa.Client, owner, alias string) error {
+	p, err := parsePrincipal(owner)
+	if err != nil {
+		return err
+	}
+
+	if p.isHost() {
+		_, err = client.HostRemovePrincipal(&freeipa.HostRemovePrincipalArgs{
+			Fqdn:             p.instance,
+			Krbprincipalname: []string{alias},
+		}, &freeipa.HostRemovePrincipalOptionalArgs{})
+	} else {
+		_, err = client.ServiceRemovePrincipal(&freeipa.ServiceRemovePrincipalArgs{
+			Krbcanonicalname: owner,
+			Krbprincipalname: []string{alias},
+		}, &freeipa.ServiceRemovePrincipalOptionalArgs{})
+	}
+
+	var ipaErr *freeipa.Error
+	if errors.As(err, &ipaErr) && (ipaErr.Code == freeipa.AttrValueNotFoundCode || ipaErr.Code == freeipa.EmptyModlistCode) {
+		return nil
+	}
+
+	return err
+}
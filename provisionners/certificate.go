@@ -0,0 +1,64 @@
+package provisioners
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+)
+
+const (
+	passwordLoginPath    = "/ipa/session/login_password"
+	certificateLoginPath = "/ipa/session/login_x509"
+)
+
+// connectWithCertificate logs in to a FreeIPA server with the client
+// certificate of the transport. The FreeIPA client only knows the password
+// login, so its login requests are sent to the certificate login endpoint
+// instead, including the ones made when its session expires.
+func connectWithCertificate(host string, tspt *http.Transport, user string) (*freeipa.Client, error) {
+	login := &http.Transport{
+		// Every request goes through the registered protocol.
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+	login.RegisterProtocol("https", &certificateLogin{next: tspt, user: user})
+
+	return freeipa.Connect(host, login, "", "")
+}
+
+// certificateLogin is a RoundTripper rewriting password logins into
+// certificate logins.
+type certificateLogin struct {
+	next http.RoundTripper
+	user string
+}
+
+func (c *certificateLogin) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != passwordLoginPath {
+		return c.next.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	// The user is only needed when the certificate is mapped to several users.
+	form := url.Values{}
+	if c.user != "" {
+		form.Set("username", c.user)
+	}
+	body := form.Encode()
+
+	login := req.Clone(req.Context())
+	login.URL.Path = certificateLoginPath
+	login.Body = io.NopCloser(strings.NewReader(body))
+	login.ContentLength = int64(len(body))
+	login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	login.Header.Set("Referer", fmt.Sprintf("https://%s/ipa", req.URL.Host))
+
+	return c.next.RoundTrip(login)
+}
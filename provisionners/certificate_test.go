@@ -0,0 +1,113 @@
+package provisioners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newClientCertificate returns a PEM encoded self-signed client certificate
+// and its key.
+func newClientCertificate(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestConnectWithCertificate(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.certUser = "issuer"
+	ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"summary": "pong"}, nil
+	})
+
+	cert, key := newClientCertificate(t, "issuer")
+	otherCert, otherKey := newClientCertificate(t, "other")
+
+	tests := []struct {
+		name    string
+		creds   *Credentials
+		wantErr bool
+	}{
+		{
+			name:  "certificate",
+			creds: &Credentials{ClientCert: cert, ClientKey: key},
+		},
+		{
+			name:  "certificate with user",
+			creds: &Credentials{User: "issuer", ClientCert: cert, ClientKey: key},
+		},
+		{
+			name:    "wrong user",
+			creds:   &Credentials{User: "admin", ClientCert: cert, ClientKey: key},
+			wantErr: true,
+		},
+		{
+			name:    "unknown certificate",
+			creds:   &Credentials{ClientCert: otherCert, ClientKey: otherKey},
+			wantErr: true,
+		},
+		{
+			name:    "key mismatch",
+			creds:   &Credentials{ClientCert: cert, ClientKey: otherKey},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true}
+
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, tt.creds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// Expired sessions are renewed with the certificate too.
+			ipa.expireSessions()
+
+			if err := p.call(func(c *freeipa.Client) error {
+				_, err := c.Ping(&freeipa.PingArgs{}, &freeipa.PingOptionalArgs{})
+				return err
+			}); err != nil {
+				t.Errorf("Ping() error = %v", err)
+			}
+		})
+	}
+}
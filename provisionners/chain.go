@@ -0,0 +1,75 @@
+package provisioners
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+)
+
+// splitChain orders and verifies the certificate chain of leaf, and splits it
+// as cert-manager expects: the leaf certificate and the intermediate CAs,
+// then the root CA. The chain may be in any order and include leaf.
+func splitChain(leaf string, chain []string) (string, string, error) {
+	leafCert, err := pki.DecodeX509CertificateBytes([]byte(formatCertificate(leaf)))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode certificate: %v", err)
+	}
+
+	certs := []*x509.Certificate{leafCert}
+	for _, c := range chain {
+		cert, err := pki.DecodeX509CertificateBytes([]byte(formatCertificate(c)))
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decode certificate of the chain: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	bundle, err := pki.ParseSingleCertificateChain(certs)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid certificate chain: %v", err)
+	}
+	if len(bundle.CAPEM) == 0 {
+		return "", "", fmt.Errorf("certificate chain has no CA")
+	}
+
+	ordered, err := pki.DecodeX509CertificateChainBytes(bundle.ChainPEM)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode certificate chain: %v", err)
+	}
+	if !ordered[0].Equal(leafCert) {
+		return "", "", fmt.Errorf("certificate chain is not the one of certificate %s", leafCert.SerialNumber)
+	}
+
+	ca, err := pki.DecodeX509CertificateBytes(bundle.CAPEM)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode CA certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	intermediates := x509.NewCertPool()
+	for _, cert := range ordered[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leafCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return "", "", fmt.Errorf("failed to verify certificate chain: %v", err)
+	}
+
+	return string(bundle.ChainPEM), string(bundle.CAPEM), nil
+}
+
+// caChain returns the certificate chain of a CA, or only its certificate
+// when FreeIPA did not return the chain.
+func caChain(ca *freeipa.CaShowResult) []string {
+	if ca.Result.CertificateChain != nil && len(*ca.Result.CertificateChain) > 0 {
+		return *ca.Result.CertificateChain
+	}
+
+	return []string{ca.Result.Certificate}
+}
@@ -0,0 +1,108 @@
+package provisioners
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func Test_splitChain(t *testing.T) {
+	chain := newFakeChain(t)
+	other := newFakeChain(t)
+
+	tests := []struct {
+		name    string
+		chain   []string
+		wantErr bool
+	}{
+		{
+			name:  "leaf to root",
+			chain: []string{chain.leaf, chain.intermediate, chain.root},
+		},
+		{
+			name:  "root to leaf",
+			chain: []string{chain.root, chain.intermediate, chain.leaf},
+		},
+		{
+			name:  "without leaf",
+			chain: []string{chain.intermediate, chain.root},
+		},
+		{
+			name:    "missing intermediate",
+			chain:   []string{chain.leaf, chain.root},
+			wantErr: true,
+		},
+		{
+			name:    "other chain",
+			chain:   []string{other.intermediate, other.root},
+			wantErr: true,
+		},
+		{
+			name:    "no CA",
+			chain:   []string{chain.leaf},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, ca, err := splitChain(chain.leaf, tt.chain)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if want := chain.pem(t, chain.leaf, chain.intermediate); cert != want+"\n" {
+				t.Errorf("splitChain() cert = %q, want %q", cert, want)
+			}
+			if want := chain.pem(t, chain.root); ca != want+"\n" {
+				t.Errorf("splitChain() ca = %q, want %q", ca, want)
+			}
+		})
+	}
+}
+
+func TestFreeIPAPKI_showCertificate(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	ipa.handle("cert_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "certificate not found"}
+	})
+	ipa.handle("ca_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"value": "ipa", "result": map[string]interface{}{
+			"cn":                []interface{}{"ipa"},
+			"ipacaid":           []interface{}{"1"},
+			"ipacasubjectdn":    []interface{}{"CN=team-ca"},
+			"ipacaissuerdn":     []interface{}{"CN=Certificate Authority,O=EXAMPLE.TEST"},
+			"certificate":       ipa.chain.intermediate,
+			"certificate_chain": []interface{}{ipa.chain.intermediate, ipa.chain.root},
+		}}, nil
+	})
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, Ca: "ipa"}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var cert, ca string
+	if err := p.call(func(c *freeipa.Client) error {
+		var err error
+		cert, ca, err = p.showCertificate(context.Background(), c, 3, ipa.chain.leaf)
+		return err
+	}); err != nil {
+		t.Fatalf("showCertificate() error = %v", err)
+	}
+
+	if want := ipa.chain.pem(t, ipa.chain.leaf, ipa.chain.intermediate); cert != want+"\n" {
+		t.Errorf("showCertificate() cert = %q, want %q", cert, want)
+	}
+	if want := ipa.chain.pem(t, ipa.chain.root); ca != want+"\n" {
+		t.Errorf("showCertificate() ca = %q, want %q", ca, want)
+	}
+}
@@ -0,0 +1,209 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DNS returns the DNS record settings of the issuer, nil when it creates no
+// records.
+func (s *FreeIPAPKI) DNS() *api.DNSSpec {
+	if s.spec.DNS == nil || !s.spec.DNS.Enabled {
+		return nil
+	}
+
+	return s.spec.DNS
+}
+
+// dnsRecord is a record of a host pointing to a target.
+type dnsRecord struct {
+	recordType string
+	target     string
+}
+
+// dnsRecords returns the records pointing to the targets: A and AAAA records
+// for IP addresses, or a CNAME record for a host name.
+func dnsRecords(targets []string) ([]dnsRecord, error) {
+	var records []dnsRecord
+	for _, target := range targets {
+		ip := net.ParseIP(target)
+		switch {
+		case ip == nil:
+			if len(targets) > 1 {
+				return nil, fmt.Errorf("CNAME target %s must be the only DNS target", target)
+			}
+			records = append(records, dnsRecord{recordType: "CNAME", target: strings.TrimSuffix(target, ".") + "."})
+		case ip.To4() != nil:
+			records = append(records, dnsRecord{recordType: "A", target: ip.String()})
+		default:
+			records = append(records, dnsRecord{recordType: "AAAA", target: ip.String()})
+		}
+	}
+
+	return records, nil
+}
+
+// dnsZone returns the zone holding the host among the zones, the most
+// specific one, and the name of the host relative to it.
+func dnsZone(zones []string, host string) (string, string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var zone, name string
+	for _, z := range zones {
+		z = strings.ToLower(strings.TrimSuffix(z, "."))
+		switch {
+		case len(z) <= len(zone):
+			continue
+		case host == z:
+			zone, name = z, "@"
+		case strings.HasSuffix(host, "."+z):
+			zone, name = z, strings.TrimSuffix(host, "."+z)
+		}
+	}
+
+	return zone, name, zone != ""
+}
+
+// recordValues returns the record options of dnsrecord_add and dnsrecord_del
+// holding the target, the one of its record type being set.
+func recordValues(recordType, target string) (a, aaaa, cname *[]string) {
+	values := &[]string{target}
+	switch recordType {
+	case "A":
+		return values, nil, nil
+	case "AAAA":
+		return nil, values, nil
+	default:
+		return nil, nil, values
+	}
+}
+
+// SetDNSRecords creates the records pointing the hosts to the targets, in
+// the zones of the issuer, and deletes the managed records of the hosts
+// pointing elsewhere, so that a host whose targets change points to the new
+// ones only. It returns the records it created for the CertificateRequest and
+// the managed records it deleted. Records that already exist are skipped, and
+// the records the issuer did not create are kept.
+func (s *FreeIPAPKI) SetDNSRecords(ctx context.Context, cr *certmanager.CertificateRequest, hosts []string, targets []string, managed []api.ManagedEntry) ([]api.ManagedEntry, []api.ManagedEntry, error) {
+	log := log.FromContext(ctx).WithName("dns")
+
+	dns := s.DNS()
+	if dns == nil {
+		return nil, nil, nil
+	}
+
+	records, err := dnsRecords(targets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owner := fmt.Sprintf("%s/%s", cr.Namespace, cr.Name)
+
+	var created, deleted []api.ManagedEntry
+	err = s.call(func(client *freeipa.Client) error {
+		for _, host := range hosts {
+			zone, name, ok := dnsZone(dns.Zones, host)
+			if !ok {
+				log.V(1).Info("host in no DNS zone of the issuer", "host", host)
+				continue
+			}
+
+			// Stale records go first, as a CNAME record can't be added next
+			// to other records.
+			for _, entry := range staleRecords(managed, host, records) {
+				if err := deleteDNSRecord(client, entry); err != nil {
+					return fmt.Errorf("fail deleting %s record of %s: %w", entry.RecordType, host, err)
+				}
+
+				log.Info("deleted stale DNS record", "host", host, "type", entry.RecordType, "target", entry.Target)
+				deleted = append(deleted, entry)
+			}
+
+			for _, record := range records {
+				a, aaaa, cname := recordValues(record.recordType, record.target)
+				// Raw output, as the DNS names FreeIPA returns are objects.
+				_, err := client.DnsrecordAdd(&freeipa.DnsrecordAddArgs{Idnsname: name}, &freeipa.DnsrecordAddOptionalArgs{
+					Dnszoneidnsname: freeipa.String(zone),
+					Arecord:         a,
+					Aaaarecord:      aaaa,
+					Cnamerecord:     cname,
+					Raw:             freeipa.Bool(true),
+				})
+				var ipaErr *freeipa.Error
+				if errors.As(err, &ipaErr) && ipaErr.Code == freeipa.EmptyModlistCode {
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("fail adding %s record of %s: %w", record.recordType, host, err)
+				}
+
+				log.Info("added DNS record", "host", host, "type", record.recordType, "target", record.target)
+				created = append(created, api.ManagedEntry{
+					Kind:               api.ManagedEntryDNSRecord,
+					Name:               host,
+					Zone:               zone,
+					RecordType:         record.recordType,
+					Target:             record.target,
+					CertificateRequest: owner,
+				})
+			}
+		}
+
+		return nil
+	})
+
+	return created, deleted, err
+}
+
+// staleRecords returns the managed records of the host which point to none
+// of the records.
+func staleRecords(managed []api.ManagedEntry, host string, records []dnsRecord) []api.ManagedEntry {
+	var stale []api.ManagedEntry
+	for _, entry := range managed {
+		if entry.Kind != api.ManagedEntryDNSRecord || !strings.EqualFold(entry.Name, host) {
+			continue
+		}
+
+		found := false
+		for _, record := range records {
+			found = found || (entry.RecordType == record.recordType && entry.Target == record.target)
+		}
+		if !found {
+			stale = append(stale, entry)
+		}
+	}
+
+	return stale
+}
+
+// deleteDNSRecord deletes a record created by the issuer. Records already
+// gone are ignored.
+func deleteDNSRecord(client *freeipa.Client, entry api.ManagedEntry) error {
+	_, name, ok := dnsZone([]string{entry.Zone}, entry.Name)
+	if !ok {
+		return fmt.Errorf("DNS record %s is not in zone %s", entry.Name, entry.Zone)
+	}
+
+	a, aaaa, cname := recordValues(entry.RecordType, entry.Target)
+	_, err := client.DnsrecordDel(&freeipa.DnsrecordDelArgs{Idnsname: name}, &freeipa.DnsrecordDelOptionalArgs{
+		Dnszoneidnsname: freeipa.String(entry.Zone),
+		Arecord:         a,
+		Aaaarecord:      aaaa,
+		Cnamerecord:     cname,
+	})
+
+	var ipaErr *freeipa.Error
+	if errors.As(err, &ipaErr) && (ipaErr.Code == freeipa.AttrValueNotFoundCode || ipaErr.Code == freeipa.NotFoundCode) {
+		return nil
+	}
+
+	return err
+}
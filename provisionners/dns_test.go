@@ -0,0 +1,134 @@
+package provisioners
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSetDNSRecords(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	d := ipa.handleDirectory()
+
+	d.records["api.example.test"] = []string{"A 10.0.0.1"}
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, DNS: &api.DNSSpec{Enabled: true, Zones: []string{"example.test", "lab.example.test."}}}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	cr := &certmanager.CertificateRequest{}
+	cr.Namespace, cr.Name = "default", "www"
+
+	hosts := []string{"www.example.test", "api.example.test", "www.lab.example.test", "www.other.test"}
+	created, deleted, err := p.SetDNSRecords(context.Background(), cr, hosts, []string{"10.0.0.1", "2001:db8::1"}, nil)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("SetDNSRecords() deleted = %v, error = %v", deleted, err)
+	}
+
+	wantRecords := map[string][]string{
+		"www.example.test":     {"A 10.0.0.1", "AAAA 2001:db8::1"},
+		"api.example.test":     {"A 10.0.0.1", "AAAA 2001:db8::1"},
+		"www.lab.example.test": {"A 10.0.0.1", "AAAA 2001:db8::1"},
+	}
+	if !reflect.DeepEqual(d.records, wantRecords) {
+		t.Errorf("records = %v, want %v", d.records, wantRecords)
+	}
+
+	wantCreated := []api.ManagedEntry{
+		{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.1", CertificateRequest: "default/www"},
+		{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "AAAA", Target: "2001:db8::1", CertificateRequest: "default/www"},
+		{Kind: api.ManagedEntryDNSRecord, Name: "api.example.test", Zone: "example.test", RecordType: "AAAA", Target: "2001:db8::1", CertificateRequest: "default/www"},
+		{Kind: api.ManagedEntryDNSRecord, Name: "www.lab.example.test", Zone: "lab.example.test", RecordType: "A", Target: "10.0.0.1", CertificateRequest: "default/www"},
+		{Kind: api.ManagedEntryDNSRecord, Name: "www.lab.example.test", Zone: "lab.example.test", RecordType: "AAAA", Target: "2001:db8::1", CertificateRequest: "default/www"},
+	}
+	if !reflect.DeepEqual(created, wantCreated) {
+		t.Errorf("SetDNSRecords() = %v, want %v", created, wantCreated)
+	}
+
+	// New targets replace the managed records, and keep the one that
+	// already existed.
+	updated, deleted, err := p.SetDNSRecords(context.Background(), cr, hosts[:2], []string{"10.0.0.2"}, created)
+	if err != nil {
+		t.Fatalf("SetDNSRecords() error = %v", err)
+	}
+	wantRecords = map[string][]string{
+		"www.example.test":     {"A 10.0.0.2"},
+		"api.example.test":     {"A 10.0.0.1", "A 10.0.0.2"},
+		"www.lab.example.test": {"A 10.0.0.1", "AAAA 2001:db8::1"},
+	}
+	if !reflect.DeepEqual(d.records, wantRecords) {
+		t.Errorf("records after new targets = %v, want %v", d.records, wantRecords)
+	}
+	wantUpdated := []api.ManagedEntry{
+		{Kind: api.ManagedEntryDNSRecord, Name: "www.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.2", CertificateRequest: "default/www"},
+		{Kind: api.ManagedEntryDNSRecord, Name: "api.example.test", Zone: "example.test", RecordType: "A", Target: "10.0.0.2", CertificateRequest: "default/www"},
+	}
+	if !reflect.DeepEqual(updated, wantUpdated) {
+		t.Errorf("SetDNSRecords() created = %v, want %v", updated, wantUpdated)
+	}
+	if !reflect.DeepEqual(deleted, wantCreated[:3]) {
+		t.Errorf("SetDNSRecords() deleted = %v, want %v", deleted, wantCreated[:3])
+	}
+
+	// Deleting the created records keeps the one that already existed.
+	for _, entry := range append(updated, created[3:]...) {
+		if err := p.Delete(context.Background(), entry); err != nil {
+			t.Errorf("Delete(%v) error = %v", entry, err)
+		}
+	}
+	if err := p.Delete(context.Background(), created[0]); err != nil {
+		t.Errorf("Delete() of deleted record error = %v", err)
+	}
+	wantRecords = map[string][]string{
+		"www.example.test":     {},
+		"api.example.test":     {"A 10.0.0.1"},
+		"www.lab.example.test": {},
+	}
+	if !reflect.DeepEqual(d.records, wantRecords) {
+		t.Errorf("records after Delete() = %v, want %v", d.records, wantRecords)
+	}
+}
+
+func Test_dnsRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		want    []dnsRecord
+		wantErr bool
+	}{
+		{
+			name:    "IP addresses",
+			targets: []string{"10.0.0.1", "2001:db8::1"},
+			want:    []dnsRecord{{recordType: "A", target: "10.0.0.1"}, {recordType: "AAAA", target: "2001:db8::1"}},
+		},
+		{
+			name:    "host name",
+			targets: []string{"lb.example.test"},
+			want:    []dnsRecord{{recordType: "CNAME", target: "lb.example.test."}},
+		},
+		{
+			name:    "host name and IP address",
+			targets: []string{"lb.example.test", "10.0.0.1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dnsRecords(tt.targets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dnsRecords() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dnsRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
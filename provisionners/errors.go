@@ -0,0 +1,139 @@
+package provisioners
+
+import (
+	"errors"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+)
+
+// TransportError means that no FreeIPA server could be reached, or that they
+// failed to answer. Signing may succeed later.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// AuthError means that FreeIPA refused the credentials of the issuer.
+// Signing may succeed once they are fixed.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// NotFoundError means that FreeIPA lacks an entry the request needs, such as
+// its CA, profile or principal.
+type NotFoundError struct {
+	Err error
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// DeniedError means that the FreeIPA ACLs do not allow the issuer account to
+// do what the request needs.
+type DeniedError struct {
+	Err error
+}
+
+func (e *DeniedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeniedError) Unwrap() error {
+	return e.Err
+}
+
+// CSRError means that the CSR of the request is invalid, or that FreeIPA
+// refused it.
+type CSRError struct {
+	Err error
+}
+
+func (e *CSRError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CSRError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether signing may succeed later without changing the
+// request: FreeIPA was unreachable or refused the credentials of the issuer.
+func IsTransient(err error) bool {
+	var transportErr *TransportError
+	var authErr *AuthError
+
+	return errors.As(err, &transportErr) || errors.As(err, &authErr)
+}
+
+// FreeIPAError returns the FreeIPA error behind err, nil when FreeIPA did not
+// answer with an error.
+func FreeIPAError(err error) *freeipa.Error {
+	var ipaErr *freeipa.Error
+	if errors.As(err, &ipaErr) {
+		return ipaErr
+	}
+
+	return nil
+}
+
+// classify wraps an error of a FreeIPA call in the error type telling why it
+// failed. Errors of other causes are returned as they are.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if ipaErr := FreeIPAError(err); ipaErr != nil {
+		switch {
+		case ipaErr.Code == freeipa.NetworkErrorCode || ipaErr.Code == freeipa.ServerNetworkErrorCode:
+			return &TransportError{err}
+		case ipaErr.Code >= freeipa.AuthenticationErrorCode && ipaErr.Code < freeipa.AuthorizationErrorCode:
+			return &AuthError{err}
+		case ipaErr.Code >= freeipa.AuthorizationErrorCode && ipaErr.Code < freeipa.AuthorizationErrorCode+1000:
+			return &DeniedError{err}
+		case ipaErr.Code == freeipa.NotFoundCode:
+			return &NotFoundError{err}
+		default:
+			return err
+		}
+	}
+
+	switch {
+	case errors.Is(err, errClosed):
+		return &TransportError{err}
+	case isAuthError(err):
+		return &AuthError{err}
+	case isServerError(err), IsTLSVerificationError(err):
+		return &TransportError{err}
+	default:
+		return err
+	}
+}
+
+// isCSRError reports whether FreeIPA refused a certificate request for its
+// CSR: it can't parse it, or its names do not match the principal.
+func isCSRError(err error) bool {
+	ipaErr := FreeIPAError(err)
+
+	return ipaErr != nil && (ipaErr.Code == freeipa.ValidationErrorCode || ipaErr.Code == freeipa.CertificateFormatErrorCode)
+}
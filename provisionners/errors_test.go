@@ -0,0 +1,132 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSign_errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		ipaErr    *freeipa.Error
+		request   []byte
+		down      bool
+		wantErr   interface{}
+		transient bool
+	}{
+		{
+			name:      "server down",
+			down:      true,
+			wantErr:   new(*TransportError),
+			transient: true,
+		},
+		{
+			name:    "ACL denied",
+			ipaErr:  &freeipa.Error{Code: freeipa.ACIErrorCode, Name: "ACIError", Message: "Insufficient access"},
+			wantErr: new(*DeniedError),
+		},
+		{
+			name:    "CA not found",
+			ipaErr:  &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "ipa: CA not found"},
+			wantErr: new(*NotFoundError),
+		},
+		{
+			name:    "CSR refused",
+			ipaErr:  &freeipa.Error{Code: freeipa.ValidationErrorCode, Name: "ValidationError", Message: "invalid 'csr'"},
+			wantErr: new(*CSRError),
+		},
+		{
+			name:    "invalid CSR",
+			request: []byte("not a CSR"),
+			wantErr: new(*CSRError),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+			ipa.handleDirectory()
+			if tt.ipaErr != nil {
+				ipa.handle("cert_request", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+					return nil, tt.ipaErr
+				})
+			}
+
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: "HTTP", Ca: "ipa"}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if tt.down {
+				ipa.Close()
+			}
+
+			request := tt.request
+			if request == nil {
+				request = newIPCSR(t, "www.example.test", nil, nil)
+			}
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: request}}
+			_, _, _, err = p.Sign(context.Background(), cr)
+
+			if !errors.As(err, tt.wantErr) {
+				t.Fatalf("Sign() error = %v (%T), want %T", err, err, tt.wantErr)
+			}
+			if got := IsTransient(err); got != tt.transient {
+				t.Errorf("IsTransient() = %v, want %v", got, tt.transient)
+			}
+			if tt.ipaErr != nil {
+				if got := FreeIPAError(err); got == nil || got.Code != tt.ipaErr.Code || got.Name != tt.ipaErr.Name {
+					t.Errorf("FreeIPAError() = %v, want %v", got, tt.ipaErr)
+				}
+			}
+		})
+	}
+}
+
+func Test_classify(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr interface{}
+	}{
+		{
+			name:    "expired ticket",
+			err:     &freeipa.Error{Code: freeipa.TicketExpiredCode, Name: "TicketExpired"},
+			wantErr: new(*AuthError),
+		},
+		{
+			name:    "network error",
+			err:     &freeipa.Error{Code: freeipa.ServerNetworkErrorCode, Name: "ServerNetworkError"},
+			wantErr: new(*TransportError),
+		},
+		{
+			name:    "unavailable",
+			err:     errors.New("unexpected http status code: 503"),
+			wantErr: new(*TransportError),
+		},
+		{
+			name:    "unauthorized",
+			err:     errors.New("unexpected http status code: 401"),
+			wantErr: new(*AuthError),
+		},
+		{
+			name:    "request rejected",
+			err:     &RejectedError{"certificate request 1 is rejected"},
+			wantErr: new(*RejectedError),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := classify(tt.err); !errors.As(err, tt.wantErr) {
+				t.Errorf("classify() = %v (%T), want %T", err, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,582 @@
+package provisioners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+const fakeIPASessionCookie = "ipa_session"
+
+// fakeMethod answers a JSON-RPC call with the content of the "result" field,
+// or with a FreeIPA error.
+type fakeMethod func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error)
+
+// fakeIPA is a FreeIPA stand-in serving the login endpoints and the JSON-RPC
+// API over TLS.
+type fakeIPA struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	user     string
+	password string
+	keytab   *keytab.Keytab
+	certUser string
+	sessions map[string]bool
+	logins   int
+	refusals int
+	methods  map[string]fakeMethod
+	calls    []string
+
+	chain *fakeChain
+}
+
+func newFakeIPA(t *testing.T) *fakeIPA {
+	t.Helper()
+
+	f := &fakeIPA{
+		sessions: map[string]bool{},
+		methods:  map[string]fakeMethod{},
+		chain:    newFakeChain(t),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipa/session/login_password", f.loginPassword)
+	mux.HandleFunc("/ipa/session/login_kerberos", f.loginKerberos)
+	mux.HandleFunc("/ipa/session/login_x509", f.loginCertificate)
+	mux.HandleFunc("/ipa/session/json", f.json)
+
+	f.Server = httptest.NewUnstartedServer(mux)
+	f.Server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	f.StartTLS()
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// host returns the address to give to the provisioner.
+func (f *fakeIPA) host() string {
+	return strings.TrimPrefix(f.URL, "https://")
+}
+
+// handle registers the answer to a JSON-RPC method.
+func (f *fakeIPA) handle(method string, m fakeMethod) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.methods[method] = m
+}
+
+// called returns the JSON-RPC methods called so far.
+func (f *fakeIPA) called() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.calls...)
+}
+
+// expireSessions makes the current sessions answer with a TicketExpired
+// error, as FreeIPA does once the Kerberos credentials of a session expire.
+func (f *fakeIPA) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id := range f.sessions {
+		f.sessions[id] = false
+	}
+}
+
+// loginCount returns the number of successful logins so far.
+func (f *fakeIPA) loginCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.logins
+}
+
+// refusalCount returns the number of refused logins so far.
+func (f *fakeIPA) refusalCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.refusals
+}
+
+func (f *fakeIPA) newSession(w http.ResponseWriter) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	f.mu.Lock()
+	f.sessions[id] = true
+	f.logins++
+	f.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: fakeIPASessionCookie, Value: id, Path: "/ipa", Secure: true})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeIPA) loginPassword(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	ok := f.user != "" && r.PostFormValue("user") == f.user && r.PostFormValue("password") == f.password
+	if !ok {
+		f.refusals++
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		w.Header().Set("X-IPA-Rejection-Reason", "invalid-password")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.newSession(w)
+}
+
+func (f *fakeIPA) loginKerberos(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	kt := f.keytab
+	f.mu.Unlock()
+
+	if kt == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	spnego.SPNEGOKRB5Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.newSession(w)
+	}), kt, service.DecodePAC(false)).ServeHTTP(w, r)
+}
+
+// loginCertificate accepts client certificates whose common name is certUser.
+func (f *fakeIPA) loginCertificate(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	user := f.certUser
+	f.mu.Unlock()
+
+	ok := user != "" && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 &&
+		r.TLS.PeerCertificates[0].Subject.CommonName == user
+	if username := r.PostFormValue("username"); username != "" && username != user {
+		ok = false
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.newSession(w)
+}
+
+func (f *fakeIPA) json(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(fakeIPASessionCookie)
+
+	var valid, known bool
+	f.mu.Lock()
+	if err == nil {
+		valid, known = f.sessions[c.Value]
+	}
+	f.mu.Unlock()
+
+	if !known {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Method string        `json:"method"`
+		Params []interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	var options map[string]interface{}
+	if len(req.Params) == 2 {
+		args, _ = req.Params[0].([]interface{})
+		options, _ = req.Params[1].(map[string]interface{})
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, req.Method)
+	m, ok := f.methods[req.Method]
+	f.mu.Unlock()
+
+	var res struct {
+		Result interface{}    `json:"result"`
+		Error  *freeipa.Error `json:"error"`
+	}
+	switch {
+	case !valid:
+		res.Error = &freeipa.Error{Code: freeipa.TicketExpiredCode, Name: "TicketExpired", Message: "Ticket expired"}
+	case ok:
+		res.Result, res.Error = m(args, options)
+	default:
+		res.Error = &freeipa.Error{Code: freeipa.CommandErrorCode, Name: "CommandError", Message: "unknown command '" + req.Method + "'"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// fakeDirectory holds the hosts and services of a fakeIPA.
+type fakeDirectory struct {
+	hosts        map[string]bool
+	descriptions map[string]string
+	services     map[string][]string
+	hostAliases  map[string][]string
+	managedBy    map[string][]string
+	records      map[string][]string
+	profile      string
+	principal    string
+}
+
+// handleDirectory registers the host, service and certificate methods used
+// to sign certificates.
+func (f *fakeIPA) handleDirectory() *fakeDirectory {
+	d := &fakeDirectory{hosts: map[string]bool{}, descriptions: map[string]string{}, services: map[string][]string{}, hostAliases: map[string][]string{}, managedBy: map[string][]string{}, records: map[string][]string{}}
+
+	notFound := &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "not found"}
+
+	f.handle("host_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		fqdn, _ := options["fqdn"].(string)
+		if !d.hosts[fqdn] {
+			return nil, notFound
+		}
+		result := map[string]interface{}{"fqdn": []interface{}{fqdn}}
+		if description, ok := d.descriptions[fqdn]; ok {
+			result["description"] = []interface{}{description}
+		}
+		return map[string]interface{}{"value": fqdn, "result": result}, nil
+	})
+	f.handle("host_add", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		fqdn, _ := options["fqdn"].(string)
+		d.hosts[fqdn] = true
+		if description, ok := options["description"].(string); ok {
+			d.descriptions[fqdn] = description
+		}
+		return map[string]interface{}{"value": fqdn, "result": map[string]interface{}{"fqdn": []interface{}{fqdn}}}, nil
+	})
+	f.handle("host_del", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		fqdns, _ := options["fqdn"].([]interface{})
+		for _, fqdn := range fqdns {
+			if !d.hosts[fqdn.(string)] {
+				return nil, notFound
+			}
+			delete(d.hosts, fqdn.(string))
+			delete(d.descriptions, fqdn.(string))
+		}
+		return map[string]interface{}{"value": fqdns, "result": map[string]interface{}{"failed": []interface{}{}}}, nil
+	})
+	f.handle("service_find", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		var result []interface{}
+		if len(args) > 0 {
+			if _, ok := d.services[args[0].(string)]; ok {
+				result = append(result, map[string]interface{}{"krbcanonicalname": []interface{}{args[0]}})
+			}
+		}
+		return map[string]interface{}{"count": len(result), "truncated": false, "result": result}, nil
+	})
+	service := func(name string) map[string]interface{} {
+		principals := []interface{}{name + "@EXAMPLE.TEST"}
+		for _, p := range d.services[name] {
+			principals = append(principals, p+"@EXAMPLE.TEST")
+		}
+		return map[string]interface{}{
+			"value": name,
+			"result": map[string]interface{}{
+				"krbcanonicalname":                         []interface{}{name + "@EXAMPLE.TEST"},
+				"krbprincipalname":                         principals,
+				"subject":                                  "CN=" + name,
+				"serial_number":                            "1",
+				"serial_number_hex":                        "0x1",
+				"issuer":                                   "CN=Certificate Authority",
+				"valid_not_before":                         "Mon Jan 01 00:00:00 2024 UTC",
+				"valid_not_after":                          "Wed Jan 01 00:00:00 2025 UTC",
+				"managedby_host":                           "",
+				"sha1_fingerprint":                         "00",
+				"sha256_fingerprint":                       "00",
+				"ipaallowedtoperform_read_keys_user":       "",
+				"ipaallowedtoperform_read_keys_group":      "",
+				"ipaallowedtoperform_read_keys_host":       "",
+				"ipaallowedtoperform_read_keys_hostgroup":  "",
+				"ipaallowedtoperform_write_keys_user":      "",
+				"ipaallowedtoperform_write_keys_group":     "",
+				"ipaallowedtoperform_write_keys_host":      "",
+				"ipaallowedtoperform_write_keys_hostgroup": "",
+			},
+		}
+	}
+	f.handle("service_add", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		name, _ := options["krbcanonicalname"].(string)
+		d.services[name] = nil
+		return service(name), nil
+	})
+	f.handle("service_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		name, _ := options["krbcanonicalname"].(string)
+		if _, ok := d.services[name]; !ok {
+			return nil, notFound
+		}
+		return service(name), nil
+	})
+	f.handle("service_del", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		names, _ := options["krbcanonicalname"].([]interface{})
+		for _, name := range names {
+			if _, ok := d.services[name.(string)]; !ok {
+				return nil, notFound
+			}
+			delete(d.services, name.(string))
+		}
+		return map[string]interface{}{"value": names, "result": map[string]interface{}{"failed": []interface{}{}}}, nil
+	})
+	f.handle("service_add_principal", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		name, _ := options["krbcanonicalname"].(string)
+		aliases, _ := options["krbprincipalname"].([]interface{})
+		for _, alias := range aliases {
+			for _, p := range d.services[name] {
+				if p == alias {
+					return nil, &freeipa.Error{Code: freeipa.EmptyModlistCode, Name: "EmptyModlist", Message: "no modifications to be performed"}
+				}
+			}
+			d.services[name] = append(d.services[name], alias.(string))
+		}
+		return service(name), nil
+	})
+	f.handle("service_remove_principal", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		name, _ := options["krbcanonicalname"].(string)
+		aliases, _ := options["krbprincipalname"].([]interface{})
+		if _, ok := d.services[name]; !ok {
+			return nil, notFound
+		}
+		for _, alias := range aliases {
+			remaining, found := removeString(d.services[name], alias.(string))
+			if !found {
+				return nil, &freeipa.Error{Code: freeipa.AttrValueNotFoundCode, Name: "AttrValueNotFound", Message: "principal alias not found"}
+			}
+			d.services[name] = remaining
+		}
+		return service(name), nil
+	})
+	f.handle("host_add_principal", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		fqdn, _ := options["fqdn"].(string)
+		aliases, _ := options["krbprincipalname"].([]interface{})
+		if !d.hosts[fqdn] {
+			return nil, notFound
+		}
+		for _, alias := range aliases {
+			if _, found := removeString(d.hostAliases[fqdn], alias.(string)); found {
+				return nil, &freeipa.Error{Code: freeipa.EmptyModlistCode, Name: "EmptyModlist", Message: "no modifications to be performed"}
+			}
+			d.hostAliases[fqdn] = append(d.hostAliases[fqdn], alias.(string))
+		}
+		return map[string]interface{}{"value": fqdn, "result": map[string]interface{}{"fqdn": []interface{}{fqdn}}}, nil
+	})
+	f.handle("host_remove_principal", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		fqdn, _ := options["fqdn"].(string)
+		aliases, _ := options["krbprincipalname"].([]interface{})
+		if !d.hosts[fqdn] {
+			return nil, notFound
+		}
+		for _, alias := range aliases {
+			remaining, found := removeString(d.hostAliases[fqdn], alias.(string))
+			if !found {
+				return nil, &freeipa.Error{Code: freeipa.AttrValueNotFoundCode, Name: "AttrValueNotFound", Message: "principal alias not found"}
+			}
+			d.hostAliases[fqdn] = remaining
+		}
+		return map[string]interface{}{"value": fqdn, "result": map[string]interface{}{"fqdn": []interface{}{fqdn}}}, nil
+	})
+	f.handle("host_add_managedby", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		fqdn, _ := options["fqdn"].(string)
+		managers, _ := options["host"].([]interface{})
+		if !d.hosts[fqdn] {
+			return nil, notFound
+		}
+		failed := []interface{}{}
+		completed := 0
+		for _, manager := range managers {
+			switch _, found := removeString(d.managedBy[fqdn], manager.(string)); {
+			case found:
+				failed = append(failed, []interface{}{manager, freeipa.FailedReasonAlreadyAMember})
+			case !d.hosts[manager.(string)]:
+				failed = append(failed, []interface{}{manager, freeipa.FailedReasonNoSuchEntry})
+			default:
+				d.managedBy[fqdn] = append(d.managedBy[fqdn], manager.(string))
+				completed++
+			}
+		}
+		return map[string]interface{}{
+			"result":    map[string]interface{}{"fqdn": []interface{}{fqdn}},
+			"failed":    map[string]interface{}{"managedby": map[string]interface{}{"host": failed}},
+			"completed": completed,
+		}, nil
+	})
+	// DNS records are keyed by "name.zone" and hold "TYPE target" values.
+	recordValues := func(options map[string]interface{}) []string {
+		var values []string
+		for option, recordType := range map[string]string{"arecord": "A", "aaaarecord": "AAAA", "cnamerecord": "CNAME"} {
+			targets, _ := options[option].([]interface{})
+			for _, target := range targets {
+				values = append(values, recordType+" "+target.(string))
+			}
+		}
+		return values
+	}
+	f.handle("dnsrecord_add", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		name, _ := options["idnsname"].(string)
+		key := name + "." + options["dnszoneidnsname"].(string)
+		for _, value := range recordValues(options) {
+			if _, found := removeString(d.records[key], value); found {
+				return nil, &freeipa.Error{Code: freeipa.EmptyModlistCode, Name: "EmptyModlist", Message: "no modifications to be performed"}
+			}
+			d.records[key] = append(d.records[key], value)
+		}
+		return map[string]interface{}{"value": name, "result": map[string]interface{}{"idnsname": []interface{}{name}}}, nil
+	})
+	f.handle("dnsrecord_del", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		name, _ := options["idnsname"].(string)
+		key := name + "." + options["dnszoneidnsname"].(string)
+		if _, ok := d.records[key]; !ok {
+			return nil, notFound
+		}
+		for _, value := range recordValues(options) {
+			remaining, found := removeString(d.records[key], value)
+			if !found {
+				return nil, &freeipa.Error{Code: freeipa.AttrValueNotFoundCode, Name: "AttrValueNotFound", Message: "record not found"}
+			}
+			d.records[key] = remaining
+		}
+		return map[string]interface{}{"value": []interface{}{name}, "result": map[string]interface{}{"failed": []interface{}{}}}, nil
+	})
+	f.handle("cert_request", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		d.profile, _ = options["profile_id"].(string)
+		d.principal, _ = options["principal"].(string)
+		return map[string]interface{}{"value": 0, "result": map[string]interface{}{"serial_number": 1, "certificate": f.chain.leaf}}, nil
+	})
+	f.handle("cert_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"value": 1, "result": map[string]interface{}{
+			"certificate":        f.chain.leaf,
+			"certificate_chain":  []interface{}{f.chain.leaf, f.chain.intermediate, f.chain.root},
+			"subject":            "CN=www.example.test",
+			"issuer":             "CN=Certificate Authority",
+			"serial_number":      []interface{}{"1"},
+			"serial_number_hex":  "0x1",
+			"valid_not_before":   []interface{}{map[string]interface{}{"__datetime__": "20240101000000Z"}},
+			"valid_not_after":    []interface{}{map[string]interface{}{"__datetime__": "20250101000000Z"}},
+			"sha1_fingerprint":   "00",
+			"sha256_fingerprint": "00",
+			"status":             "VALID",
+			"revoked":            false,
+			"revocation_reason":  []interface{}{"0"},
+		}}, nil
+	})
+
+	return d
+}
+
+// fakeChain is a certificate signed by an intermediate CA signed by a root
+// CA, base64 encoded as FreeIPA returns them.
+type fakeChain struct {
+	root         string
+	intermediate string
+	leaf         string
+
+	intermediateKey *ecdsa.PrivateKey
+	leafKey         *ecdsa.PrivateKey
+}
+
+func newFakeChain(t *testing.T) *fakeChain {
+	t.Helper()
+
+	issue := func(tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key, base64.StdEncoding.EncodeToString(der)
+	}
+
+	root, rootKey, rootB64 := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Certificate Authority", Organization: []string{"EXAMPLE.TEST"}},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	intermediate, intermediateKey, intermediateB64 := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "team-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, root, rootKey)
+	_, leafKey, leafB64 := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "www.example.test"},
+		DNSNames:     []string{"www.example.test"},
+	}, intermediate, intermediateKey)
+
+	return &fakeChain{root: rootB64, intermediate: intermediateB64, leaf: leafB64, intermediateKey: intermediateKey, leafKey: leafKey}
+}
+
+// pem returns the PEM encoding of base64 encoded certificates, as Sign
+// returns them.
+func (c *fakeChain) pem(t *testing.T, certs ...string) string {
+	t.Helper()
+
+	var out []byte
+	for _, cert := range certs {
+		der, err := base64.StdEncoding.DecodeString(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// removeString removes s from list, and reports whether it was there.
+func removeString(list []string, s string) ([]string, bool) {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i:i], list[i+1:]...), true
+		}
+	}
+
+	return list, false
+}
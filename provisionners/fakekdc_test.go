@@ -0,0 +1,209 @@
+package provisioners
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// fakeKDC is a Kerberos KDC stand-in for a single realm. It serves AS and TGS
+// exchanges over TCP, without pre-authentication, for the principals added
+// with addPrincipal.
+type fakeKDC struct {
+	realm string
+	keys  *keytab.Keytab
+	ln    net.Listener
+}
+
+const fakeKDCEtype = etypeID.AES256_CTS_HMAC_SHA1_96
+
+func newFakeKDC(t *testing.T, realm string) *fakeKDC {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	k := &fakeKDC{
+		realm: realm,
+		keys:  keytab.New(),
+		ln:    ln,
+	}
+	k.addPrincipal(t, "krbtgt/"+realm, "krbtgt")
+
+	go k.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return k
+}
+
+func (k *fakeKDC) addr() string {
+	return k.ln.Addr().String()
+}
+
+// addPrincipal registers a principal and returns a keytab holding its key.
+func (k *fakeKDC) addPrincipal(t *testing.T, name, password string) *keytab.Keytab {
+	t.Helper()
+
+	ts := time.Now()
+	if err := k.keys.AddEntry(name, k.realm, password, ts, 1, fakeKDCEtype); err != nil {
+		t.Fatalf("failed to add %s to KDC: %v", name, err)
+	}
+
+	kt := keytab.New()
+	if err := kt.AddEntry(name, k.realm, password, ts, 1, fakeKDCEtype); err != nil {
+		t.Fatalf("failed to create keytab for %s: %v", name, err)
+	}
+
+	return kt
+}
+
+func (k *fakeKDC) serve() {
+	for {
+		conn, err := k.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var size uint32
+			if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+				return
+			}
+			req := make([]byte, size)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+
+			rep, err := k.exchange(req)
+			if err != nil {
+				return
+			}
+
+			_ = binary.Write(conn, binary.BigEndian, uint32(len(rep)))
+			_, _ = conn.Write(rep)
+		}()
+	}
+}
+
+func (k *fakeKDC) exchange(b []byte) ([]byte, error) {
+	var asReq messages.ASReq
+	if err := asReq.Unmarshal(b); err == nil {
+		return k.asRep(asReq)
+	}
+
+	var tgsReq messages.TGSReq
+	if err := tgsReq.Unmarshal(b); err == nil {
+		return k.tgsRep(tgsReq)
+	}
+
+	return nil, fmt.Errorf("unsupported KDC request")
+}
+
+func (k *fakeKDC) asRep(req messages.ASReq) ([]byte, error) {
+	clientKey, _, err := k.keys.GetEncryptionKey(req.ReqBody.CName, k.realm, 0, fakeKDCEtype)
+	if err != nil {
+		return nil, err
+	}
+
+	tkt, encPart, err := k.ticket(req.ReqBody.CName, req.ReqBody.SName, req.ReqBody.Nonce, clientKey, keyusage.AS_REP_ENCPART)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := messages.ASRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AS_REP,
+		CRealm:  k.realm,
+		CName:   req.ReqBody.CName,
+		Ticket:  tkt,
+		EncPart: encPart,
+	}}
+
+	return rep.Marshal()
+}
+
+func (k *fakeKDC) tgsRep(req messages.TGSReq) ([]byte, error) {
+	var apReq messages.APReq
+	for _, pa := range req.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := apReq.Ticket.DecryptEncPart(k.keys, &apReq.Ticket.SName); err != nil {
+		return nil, err
+	}
+	tgt := apReq.Ticket.DecryptedEncPart
+
+	tkt, encPart, err := k.ticket(tgt.CName, req.ReqBody.SName, req.ReqBody.Nonce, tgt.Key, keyusage.TGS_REP_ENCPART_SESSION_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := messages.TGSRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_TGS_REP,
+		CRealm:  k.realm,
+		CName:   req.ReqBody.CName,
+		Ticket:  tkt,
+		EncPart: encPart,
+	}}
+
+	return rep.Marshal()
+}
+
+// ticket issues a ticket for sname and the reply part holding its session
+// key, encrypted with key.
+func (k *fakeKDC) ticket(cname, sname types.PrincipalName, nonce int, key types.EncryptionKey, usage uint32) (messages.Ticket, types.EncryptedData, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	end := now.Add(time.Hour)
+	flags := types.NewKrbFlags()
+
+	tkt, sessionKey, err := messages.NewTicket(cname, k.realm, sname, k.realm, flags, k.keys, fakeKDCEtype, 0, now, now, end, end)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptedData{}, err
+	}
+
+	enc := messages.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReqs:  []messages.LastReq{{LRValue: now}},
+		Nonce:     nonce,
+		Flags:     flags,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   end,
+		RenewTill: end,
+		SRealm:    k.realm,
+		SName:     sname,
+	}
+	b, err := enc.Marshal()
+	if err != nil {
+		return messages.Ticket{}, types.EncryptedData{}, err
+	}
+
+	encPart, err := crypto.GetEncryptedData(b, key, usage, 1)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptedData{}, err
+	}
+
+	return tkt, encPart, nil
+}
@@ -2,66 +2,214 @@ package provisioners
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
+	"github.com/ccin2p3/go-freeipa/freeipa"
 	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 	"github.com/jetstack/cert-manager/pkg/util/pki"
-	"github.com/tehwalris/go-freeipa/freeipa"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-var collection = new(sync.Map)
-
 // FreeIPAPKI
 type FreeIPAPKI struct {
-	client *freeipa.Client
-	spec   *api.IssuerSpec
+	// serversMu guards servers, which change as they are discovered again,
+	// and closed, so that no server is added once the provisioner is closed.
+	serversMu sync.RWMutex
+	servers   []*server
+	closed    bool
+
+	connect   connectFunc
+	transport *http.Transport
+	spec      *api.IssuerSpec
+
+	principalFormat *template.Template
 
 	name string
+
+	// clusterName names the cluster in the description of the hosts
+	clusterName string
+
+	// credentials fingerprint of the credentials it logs in with
+	credentials [sha256.Size]byte
+
+	// refusedMu guards refused, the error of FreeIPA refusing the
+	// credentials. The provisioner logs in no more once they are refused, so
+	// that the account is not locked out.
+	refusedMu sync.Mutex
+	refused   error
+}
+
+// Credentials holds what is needed to log in to FreeIPA, either a user and
+// its password, a Kerberos keytab or a client certificate.
+type Credentials struct {
+	User     string
+	Password string
+	Keytab   []byte
+
+	// ClientCert and ClientKey PEM encoded certificate and key used to log in
+	// with a certificate.
+	ClientCert []byte
+	ClientKey  []byte
+
+	// CABundle PEM encoded CA certificates trusted to verify the server.
+	CABundle []byte
+}
+
+// fingerprint returns a hash of the credentials, to know whether a
+// provisioner was built with them without keeping them.
+func (c *Credentials) fingerprint() [sha256.Size]byte {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(c.User), []byte(c.Password), c.Keytab, c.ClientCert, c.ClientKey, c.CABundle} {
+		_ = binary.Write(h, binary.BigEndian, uint64(len(field)))
+		h.Write(field)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
 }
 
 // New returns a new provisioner, configured with the information in the
-// given issuer.
-func New(namespacedName types.NamespacedName, spec *api.IssuerSpec, user, password string, insecure bool) (*FreeIPAPKI, error) {
-	tspt := http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: insecure,
-		},
+// given issuer, for the DefaultClusterName cluster.
+func New(namespacedName types.NamespacedName, spec *api.IssuerSpec, creds *Credentials) (*FreeIPAPKI, error) {
+	return newProvisioner(namespacedName, spec, creds, DefaultClusterName)
+}
+
+// newProvisioner returns a new provisioner for the named cluster.
+func newProvisioner(namespacedName types.NamespacedName, spec *api.IssuerSpec, creds *Credentials, clusterName string) (*FreeIPAPKI, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: spec.Insecure,
 	}
 
-	client, err := freeipa.Connect(spec.Host, &tspt, user, password)
+	if len(creds.CABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(creds.CABundle) {
+			return nil, fmt.Errorf("no valid certificate found in CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(creds.ClientCert) > 0 {
+		cert, err := tls.X509KeyPair(creds.ClientCert, creds.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := newTransport(tlsConfig)
+	tspt := withTimeout(transport, requestTimeout)
+
+	hosts, err := serverHosts(spec)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := validatePolicy(spec.Policy); err != nil {
+		return nil, err
+	}
+
+	principalFormat, err := parsePrincipalFormat(spec.Principal)
+	if err != nil {
+		return nil, &VerificationError{Reason: ReasonInvalidPrincipal, Err: err}
+	}
+
 	p := &FreeIPAPKI{
-		name:   fmt.Sprintf("%s.%s", namespacedName.Name, namespacedName.Namespace),
-		client: client,
-		spec:   spec,
+		name:      fmt.Sprintf("%s.%s", namespacedName.Name, namespacedName.Namespace),
+		transport: transport,
+		spec:      spec,
+
+		principalFormat: principalFormat,
+		clusterName:     clusterName,
+		credentials:     creds.fingerprint(),
+	}
+
+	for _, host := range hosts {
+		p.servers = append(p.servers, &server{host: host})
+	}
+
+	p.connect = func(host string) (*freeipa.Client, error) {
+		return freeipa.Connect(host, tspt, creds.User, creds.Password)
+	}
+	switch {
+	case len(creds.Keytab) > 0:
+		p.connect = func(host string) (*freeipa.Client, error) {
+			return connectWithKeytab(spec, host, p.hosts(), tspt, creds)
+		}
+	case len(creds.ClientCert) > 0:
+		p.connect = func(host string) (*freeipa.Client, error) {
+			return connectWithCertificate(host, tspt, creds.User)
+		}
+	}
+
+	// Log in to every server to know their health, at least one must work.
+	// The servers share the accounts: once one refuses the credentials, the
+	// others are not tried.
+	var loginErr error
+	for _, srv := range p.servers {
+		_, err := srv.session(p.connect)
+		srv.report(err)
+
+		if err != nil && isAuthError(err) {
+			p.Close()
+			return nil, err
+		}
+		if err != nil && loginErr == nil {
+			loginErr = err
+		}
 	}
 
-	return p, nil
+	for _, srv := range p.servers {
+		if srv.healthy() {
+			return p, nil
+		}
+	}
+
+	return nil, loginErr
 }
 
-// Load returns a provisioner by NamespacedName.
-func Load(namespacedName types.NamespacedName) (*FreeIPAPKI, bool) {
-	v, ok := collection.Load(namespacedName)
-	if !ok {
-		return nil, ok
+// IsTLSVerificationError reports whether err is caused by the verification
+// of the FreeIPA server certificate.
+func IsTLSVerificationError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return true
 	}
-	p, ok := v.(*FreeIPAPKI)
-	return p, ok
+
+	// Kerberos login errors are flattened to strings by the FreeIPA client.
+	return err != nil && strings.Contains(err.Error(), "x509: ")
 }
 
-// Store adds a new provisioner to the collection by NamespacedName.
-func Store(namespacedName types.NamespacedName, provisioner *FreeIPAPKI) {
-	collection.Store(namespacedName, provisioner)
+// Close logs out of the FreeIPA servers. Calls of a closed provisioner fail
+// with a TransportError.
+func (s *FreeIPAPKI) Close() {
+	s.serversMu.Lock()
+	s.closed = true
+	servers := s.servers
+	s.serversMu.Unlock()
+
+	for _, srv := range servers {
+		srv.close()
+	}
+	s.transport.CloseIdleConnections()
 }
 
 type CertPem []byte
@@ -70,41 +218,146 @@ type CaPem []byte
 const certKey = "certificate"
 
 // Sign sends the certificate requests to the CA and returns the signed
-// certificate.
-func (s *FreeIPAPKI) Sign(ctx context.Context, cr *certmanager.CertificateRequest) (CertPem, CaPem, error) {
-	log := log.FromContext(ctx).WithName("sign").WithValues("request", cr)
-
+// certificate, with the hosts and services created in FreeIPA for it, even
+// when signing fails. Failed FreeIPA calls give a TransportError, AuthError,
+// NotFoundError or DeniedError, and invalid CSRs a CSRError.
+func (s *FreeIPAPKI) Sign(ctx context.Context, cr *certmanager.CertificateRequest) (CertPem, CaPem, []api.ManagedEntry, error) {
 	csr, err := pki.DecodeX509CertificateRequestBytes(cr.Spec.Request)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decode CSR for signing: %s", err)
-	}
-
-	if csr.Subject.CommonName == "" {
-		return nil, nil, fmt.Errorf("Request has no common name")
-	}
-
-	// Adding Host
-	if s.spec.AddHost {
-		if _, err := s.client.HostShow(&freeipa.HostShowArgs{Fqdn: csr.Subject.CommonName}, &freeipa.HostShowOptionalArgs{}); err != nil {
-			if ipaE, ok := err.(*freeipa.Error); ok && ipaE.Code == freeipa.NotFoundCode {
-				if _, err := s.client.HostAdd(&freeipa.HostAddArgs{
-					Fqdn: csr.Subject.CommonName,
-				}, &freeipa.HostAddOptionalArgs{
-					Force: freeipa.Bool(true),
-				}); err != nil {
-					return nil, nil, fmt.Errorf("fail adding host: %v", err)
-				}
-			} else {
-				return nil, nil, fmt.Errorf("fail getting Host wi: %v", err)
+		return nil, nil, nil, &CSRError{fmt.Errorf("failed to decode CSR for signing: %s", err)}
+	}
+
+	if cr.Spec.IsCA {
+		cert, ca, err := s.signCA(ctx, cr, csr)
+		return cert, ca, nil, classify(err)
+	}
+
+	if len(hostnames(csr)) == 0 {
+		return nil, nil, nil, &CSRError{fmt.Errorf("Request has no common name nor DNS name")}
+	}
+
+	principal, err := s.principal(cr, csr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := s.checkPolicy(csr, principal); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The request was already sent and waits for the approval of a CA agent.
+	if v, ok := cr.Annotations[api.RequestIDAnnotation]; ok {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid certificate request ID %q: %v", v, err)
+		}
+
+		var certPem string
+		var caPem string
+		err = s.call(func(client *freeipa.Client) error {
+			var err error
+			certPem, caPem, err = s.requestStatus(ctx, client, id)
+			return err
+		})
+		if err != nil {
+			return nil, nil, nil, classify(err)
+		}
+
+		return []byte(strings.TrimSpace(certPem)), []byte(strings.TrimSpace(caPem)), nil, nil
+	}
+
+	profile, err := s.profile(cr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var certPem string
+	var caPem string
+	var created []api.ManagedEntry
+
+	// A previous attempt may have stopped after FreeIPA issued the
+	// certificate, which is then found instead of requesting another one.
+	var since *time.Time
+	if v, ok := cr.Annotations[api.InFlightAnnotation]; ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid signing attempt time %q: %v", v, err)
+		}
+		since = &t
+	}
+
+	// So may an attempt of this call answered with an error, which is then
+	// retried on another server or after a new login.
+	start := Clock.Now()
+	err = s.call(func(client *freeipa.Client) error {
+		if since != nil {
+			serial, der, found, err := s.findIssued(ctx, client, principal, csr, *since)
+			if err != nil {
+				return err
+			}
+			if found {
+				log.FromContext(ctx).WithName("sign").Info("found certificate issued by a previous attempt", "serial", serial)
+				certPem, caPem, err = s.showCertificate(ctx, client, serial, der)
+				return err
+			}
+		}
+		if since == nil {
+			since = &start
+		}
+
+		var err error
+		var entries []api.ManagedEntry
+		certPem, caPem, entries, err = s.sign(ctx, client, cr, csr, profile, principal)
+		created = append(created, entries...)
+		return err
+	})
+	if err != nil {
+		return nil, nil, created, classify(err)
+	}
+
+	return []byte(strings.TrimSpace(certPem)), []byte(strings.TrimSpace(caPem)), created, nil
+}
+
+// sign requests the certificate from a single FreeIPA server.
+func (s *FreeIPAPKI) sign(ctx context.Context, client *freeipa.Client, cr *certmanager.CertificateRequest, csr *x509.CertificateRequest, profile string, principal principal) (string, string, []api.ManagedEntry, error) {
+	log := log.FromContext(ctx).WithName("sign").WithValues("request", cr, "principal", principal.String())
+
+	hosts := hostnames(csr)
+	if !principal.isUser() {
+		hosts = uniqueNames(append([]string{principal.instance}, hosts...))
+	}
+	owner := fmt.Sprintf("%s/%s", cr.Namespace, cr.Name)
+
+	var created []api.ManagedEntry
+
+	// Adding Hosts, user principals have none
+	if (s.spec.AddHost || s.spec.AddManagedBy) && !principal.isUser() {
+		for _, host := range hosts {
+			added, err := addHost(client, host, s.ownerDescription(cr))
+			if err != nil {
+				return "", "", created, err
+			}
+			if added {
+				created = append(created, api.ManagedEntry{Kind: api.ManagedEntryHost, Name: host, CertificateRequest: owner})
 			}
 		}
 	}
 
-	name := fmt.Sprintf("%s/%s", s.spec.ServiceName, csr.Subject.CommonName)
+	// The hosts of the other DNS names are managed by the host of the
+	// principal for FreeIPA to accept them in the certificate.
+	if s.spec.AddManagedBy && !principal.isUser() {
+		for _, host := range hosts[1:] {
+			if err := addManagedBy(client, host, principal.instance); err != nil {
+				return "", "", created, err
+			}
+		}
+	}
 
-	// Adding service
-	if s.spec.AddService {
-		svcList, err := s.client.ServiceFind(
+	name := principal.String()
+
+	// Adding service, host and user principals are not services
+	if s.spec.AddService && !principal.isUser() && !principal.isHost() {
+		svcList, err := client.ServiceFind(
 			name,
 			&freeipa.ServiceFindArgs{},
 			&freeipa.ServiceFindOptionalArgs{
@@ -114,55 +367,230 @@ func (s *FreeIPAPKI) Sign(ctx context.Context, cr *certmanager.CertificateReques
 
 		if err != nil {
 			if !s.spec.IgnoreError {
-				return nil, nil, fmt.Errorf("fail listing services: %v", err)
+				return "", "", created, fmt.Errorf("fail listing services: %w", err)
 			}
 		} else if svcList.Count == 0 {
-			if _, err := s.client.ServiceAdd(&freeipa.ServiceAddArgs{Krbcanonicalname: name}, &freeipa.ServiceAddOptionalArgs{Force: freeipa.Bool(true)}); err != nil && !s.spec.IgnoreError {
-				return nil, nil, fmt.Errorf("fail adding service: %v", err)
+			_, err := client.ServiceAdd(&freeipa.ServiceAddArgs{Krbcanonicalname: name}, &freeipa.ServiceAddOptionalArgs{Force: freeipa.Bool(true)})
+			if err != nil && !s.spec.IgnoreError {
+				return "", "", created, fmt.Errorf("fail adding service: %w", err)
+			}
+			if err == nil {
+				created = append(created, api.ManagedEntry{Kind: api.ManagedEntryService, Name: name, CertificateRequest: owner})
 			}
 		}
 	}
 
-	result, err := s.client.CertRequest(&freeipa.CertRequestArgs{
-		Csr:       string(cr.Spec.Request),
-		Principal: name,
-	}, &freeipa.CertRequestOptionalArgs{
+	// The other DNS names must be aliases of the service or host principal
+	// for FreeIPA to accept them in the certificate.
+	addAliases := s.spec.AddService
+	if principal.isHost() {
+		addAliases = s.spec.AddHost
+	}
+	if addAliases && !principal.isUser() && len(hosts) > 1 {
+		added, err := addPrincipalAliases(client, principal, hosts[1:])
+		for _, alias := range added {
+			created = append(created, api.ManagedEntry{Kind: api.ManagedEntryPrincipalAlias, Name: alias, Principal: name, CertificateRequest: owner})
+		}
+		if err != nil && !s.spec.IgnoreError {
+			return "", "", created, err
+		}
+	}
+
+	opts := &freeipa.CertRequestOptionalArgs{
 		Cacn: &s.spec.Ca,
 		Add:  &s.spec.AddPrincipal,
-	})
+	}
+	if profile != "" {
+		opts.ProfileID = &profile
+	}
+
+	result, err := client.CertRequest(&freeipa.CertRequestArgs{
+		Csr:       string(cr.Spec.Request),
+		Principal: name,
+	}, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Fail to request certificate: %v", err)
+		err = fmt.Errorf("Fail to request certificate: %w", err)
+		if isCSRError(err) {
+			return "", "", created, &CSRError{err}
+		}
+		return "", "", created, err
 	}
 
-	reqCertShow := &freeipa.CertShowArgs{
-		SerialNumber: int(result.Result.(map[string]interface{})["serial_number"].(float64)),
+	res, _ := result.Result.(map[string]interface{})
+	serial, ok := serialNumber(res["serial_number"])
+	if !ok {
+		// Profiles requiring the approval of a CA agent only give a request ID.
+		if id, ok := requestID(res["request_id"]); ok && res[certKey] == nil {
+			log.Info("certificate request waits for approval", "requestID", id)
+			return "", "", created, &PendingError{RequestID: id}
+		}
 	}
 
-	var certPem string
-	var caPem string
+	fallback, _ := res[certKey].(string)
+	certPem, caPem, err := s.showCertificate(ctx, client, serial, fallback)
+	if err != nil {
+		return "", "", created, fmt.Errorf("%v: %s", err, result.String())
+	}
 
-	cert, err := s.client.CertShow(reqCertShow, &freeipa.CertShowOptionalArgs{Chain: freeipa.Bool(true)})
-	if err != nil || len(*cert.Result.CertificateChain) == 0 {
-		log.Error(err, "fail to get certificate FALLBACK", "requestResult", result)
+	return certPem, caPem, created, nil
+}
+
+// showCertificate returns the certificate of the serial number, or the
+// fallback certificate when FreeIPA can't show it, with its chain. When
+// FreeIPA gives no chain, it is the chain of the CA of the issuer.
+func (s *FreeIPAPKI) showCertificate(ctx context.Context, client *freeipa.Client, serial int, fallback string) (string, string, error) {
+	log := log.FromContext(ctx).WithName("sign")
+
+	leaf := fallback
+	var chain []string
 
-		c, ok := result.Result.(map[string]interface{})[certKey].(string)
-		if !ok || c == "" {
-			return nil, nil, fmt.Errorf("can't find certificate for: %s", result.String())
+	if serial != 0 {
+		cert, err := client.CertShow(&freeipa.CertShowArgs{SerialNumber: serial}, &freeipa.CertShowOptionalArgs{Chain: freeipa.Bool(true)})
+		if err != nil {
+			log.Error(err, "fail to get certificate FALLBACK", "serialNumber", serial)
+		} else {
+			if c, ok := cert.Result.Certificate.(string); ok && c != "" {
+				leaf = c
+			}
+			if cert.Result.CertificateChain != nil {
+				chain = *cert.Result.CertificateChain
+			}
 		}
+	}
 
-		certPem = formatCertificate(c)
-	} else {
-		for i, c := range *cert.Result.CertificateChain {
-			c = formatCertificate(c)
-			if i == 0 {
-				certPem = c
-			} else {
-				caPem = strings.Join([]string{caPem, c}, "\n\n")
+	if leaf == "" && len(chain) > 0 {
+		leaf = chain[0]
+	}
+	if leaf == "" {
+		return "", "", fmt.Errorf("can't find certificate %d", serial)
+	}
+
+	if len(chain) == 0 {
+		ca, err := client.CaShow(&freeipa.CaShowArgs{Cn: s.spec.Ca}, &freeipa.CaShowOptionalArgs{Chain: freeipa.Bool(true)})
+		if err != nil {
+			return "", "", fmt.Errorf("fail getting chain of CA %s: %w", s.spec.Ca, err)
+		}
+		chain = caChain(ca)
+	}
+
+	return splitChain(leaf, chain)
+}
+
+// ProfileError means that the issuer has no certificate profile to sign a
+// request with.
+type ProfileError struct {
+	msg string
+}
+
+func (e *ProfileError) Error() string {
+	return e.msg
+}
+
+// profile returns the certificate profile to sign the request with: the one
+// of its annotation when the issuer allows it, else the one of the first
+// profile mapping matching the request, else the one of the issuer.
+func (s *FreeIPAPKI) profile(cr *certmanager.CertificateRequest) (string, error) {
+	if profile, ok := cr.Annotations[api.ProfileAnnotation]; ok {
+		if profile == s.spec.Profile {
+			return profile, nil
+		}
+		for _, allowed := range s.spec.AllowedProfiles {
+			if profile == allowed {
+				return profile, nil
+			}
+		}
+
+		return "", &ProfileError{fmt.Sprintf("profile %q is not allowed by the issuer", profile)}
+	}
+
+	if len(s.spec.ProfileMappings) == 0 {
+		return s.spec.Profile, nil
+	}
+
+	duration := certmanager.DefaultCertificateDuration
+	if cr.Spec.Duration != nil {
+		duration = cr.Spec.Duration.Duration
+	}
+
+	usages := cr.Spec.Usages
+	if len(usages) == 0 {
+		usages = certmanager.DefaultKeyUsages()
+	}
+
+	for _, m := range s.spec.ProfileMappings {
+		if m.MaxDuration != nil && duration > m.MaxDuration.Duration {
+			continue
+		}
+		if len(m.Usages) > 0 && !containsUsages(m.Usages, usages) {
+			continue
+		}
+
+		return m.Profile, nil
+	}
+
+	return "", &ProfileError{fmt.Sprintf("no certificate profile of the issuer matches a duration of %s and usages %v", duration, usages)}
+}
+
+// containsUsages reports whether every usage is one of allowed.
+func containsUsages(allowed []string, usages []certmanager.KeyUsage) bool {
+	for _, usage := range usages {
+		found := false
+		for _, a := range allowed {
+			if string(usage) == a {
+				found = true
+				break
 			}
 		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hostnames returns the DNS names a certificate is requested for: the common
+// name first, then the DNS SANs.
+func hostnames(csr *x509.CertificateRequest) []string {
+	return uniqueNames(append([]string{csr.Subject.CommonName}, csr.DNSNames...))
+}
+
+// uniqueNames returns the names without the empty and duplicate ones.
+func uniqueNames(names []string) []string {
+	var unique []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	return unique
+}
+
+// addHost adds a host to FreeIPA unless it already exists, and reports
+// whether it was added.
+func addHost(client *freeipa.Client, host, description string) (bool, error) {
+	_, err := client.HostShow(&freeipa.HostShowArgs{Fqdn: host}, &freeipa.HostShowOptionalArgs{})
+	if err == nil {
+		return false, nil
+	}
+
+	if ipaE, ok := err.(*freeipa.Error); !ok || ipaE.Code != freeipa.NotFoundCode {
+		return false, fmt.Errorf("fail getting host: %w", err)
+	}
+
+	if _, err := client.HostAdd(&freeipa.HostAddArgs{
+		Fqdn: host,
+	}, &freeipa.HostAddOptionalArgs{
+		Description: freeipa.String(description),
+		Force:       freeipa.Bool(true),
+	}); err != nil {
+		return false, fmt.Errorf("fail adding host: %w", err)
 	}
 
-	return []byte(strings.TrimSpace(certPem)), []byte(strings.TrimSpace(caPem)), nil
+	return true, nil
 }
 
 func formatCertificate(cert string) string {
@@ -1,6 +1,24 @@
 package provisioners
 
-import "testing"
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
 
 func Test_formatCertificate(t *testing.T) {
 	type args struct {
@@ -48,3 +66,271 @@ func Test_formatCertificate(t *testing.T) {
 		})
 	}
 }
+
+func TestNew(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ipa.Certificate().Raw})
+
+	tests := []struct {
+		name     string
+		insecure bool
+		creds    *Credentials
+		wantErr  bool
+		wantTLS  bool
+	}{
+		{
+			name:     "password",
+			insecure: true,
+			creds:    &Credentials{User: "admin", Password: "secret"},
+		},
+		{
+			name:     "wrong password",
+			insecure: true,
+			creds:    &Credentials{User: "admin", Password: "wrong"},
+			wantErr:  true,
+		},
+		{
+			name:  "CA bundle",
+			creds: &Credentials{User: "admin", Password: "secret", CABundle: caBundle},
+		},
+		{
+			name:    "untrusted server",
+			creds:   &Credentials{User: "admin", Password: "secret"},
+			wantErr: true,
+			wantTLS: true,
+		},
+		{
+			name:    "invalid CA bundle",
+			creds:   &Credentials{User: "admin", Password: "secret", CABundle: []byte("garbage")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: tt.insecure}
+
+			_, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, tt.creds)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := IsTLSVerificationError(err); got != tt.wantTLS {
+				t.Errorf("IsTLSVerificationError() = %v, want %v", got, tt.wantTLS)
+			}
+		})
+	}
+}
+
+// newCSR returns a PEM encoded certificate request.
+func newCSR(t *testing.T, commonName string, dnsNames ...string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name         string
+		commonName   string
+		dnsNames     []string
+		annotations  map[string]string
+		wantHosts    []string
+		wantServices map[string][]string
+		wantProfile  string
+		wantErr      bool
+	}{
+		{
+			name:         "common name",
+			commonName:   "www.example.test",
+			wantHosts:    []string{"www.example.test"},
+			wantServices: map[string][]string{"HTTP/www.example.test": nil},
+		},
+		{
+			name:         "DNS names only",
+			dnsNames:     []string{"www.example.test", "api.example.test"},
+			wantHosts:    []string{"api.example.test", "www.example.test"},
+			wantServices: map[string][]string{"HTTP/www.example.test": {"HTTP/api.example.test"}},
+		},
+		{
+			name:         "allowed profile",
+			commonName:   "www.example.test",
+			annotations:  map[string]string{api.ProfileAnnotation: "shortLived"},
+			wantHosts:    []string{"www.example.test"},
+			wantServices: map[string][]string{"HTTP/www.example.test": nil},
+			wantProfile:  "shortLived",
+		},
+		{
+			name:        "forbidden profile",
+			commonName:  "www.example.test",
+			annotations: map[string]string{api.ProfileAnnotation: "caIPAuserCert"},
+			wantErr:     true,
+		},
+		{
+			name:    "no name",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+			d := ipa.handleDirectory()
+
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: "HTTP", AddHost: true, AddService: true, AddPrincipal: true, Ca: "ipa", AllowedProfiles: []string{"shortLived"}}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: newCSR(t, tt.commonName, tt.dnsNames...)}}
+			cr.Namespace, cr.Name = "default", "www"
+			cr.Annotations = tt.annotations
+			cert, ca, created, err := p.Sign(context.Background(), cr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if want := ipa.chain.pem(t, ipa.chain.leaf, ipa.chain.intermediate); string(cert) != want {
+				t.Errorf("Sign() cert = %q, want %q", cert, want)
+			}
+			if want := ipa.chain.pem(t, ipa.chain.root); string(ca) != want {
+				t.Errorf("Sign() ca = %q, want %q", ca, want)
+			}
+
+			var hosts []string
+			for host := range d.hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			if !reflect.DeepEqual(hosts, tt.wantHosts) {
+				t.Errorf("hosts = %v, want %v", hosts, tt.wantHosts)
+			}
+			if !reflect.DeepEqual(d.services, tt.wantServices) {
+				t.Errorf("services = %v, want %v", d.services, tt.wantServices)
+			}
+			if d.profile != tt.wantProfile {
+				t.Errorf("profile = %q, want %q", d.profile, tt.wantProfile)
+			}
+
+			wantCreated := len(tt.wantHosts) + len(tt.wantServices)
+			for _, aliases := range tt.wantServices {
+				wantCreated += len(aliases)
+			}
+			if len(created) != wantCreated {
+				t.Errorf("created = %v, want %d entries", created, wantCreated)
+			}
+			for _, entry := range created {
+				if entry.CertificateRequest != "default/www" {
+					t.Errorf("created entry %s for %q, want default/www", entry.Name, entry.CertificateRequest)
+				}
+			}
+			for host, description := range d.descriptions {
+				if want := "Managed by freeipa-issuer cluster=default namespace=default certificaterequest=www"; description != want {
+					t.Errorf("description of %s = %q, want %q", host, description, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeIPAPKI_profile(t *testing.T) {
+	day := 24 * time.Hour
+	spec := &api.IssuerSpec{
+		Profile:         "caIPAserviceCert",
+		AllowedProfiles: []string{"shortLived"},
+		ProfileMappings: []api.ProfileMapping{
+			{Profile: "shortLived", MaxDuration: &metav1.Duration{Duration: 30 * day}},
+			{Profile: "serverCert", MaxDuration: &metav1.Duration{Duration: 365 * day}, Usages: []string{"digital signature", "key encipherment", "server auth"}},
+			{Profile: "clientCert", MaxDuration: &metav1.Duration{Duration: 365 * day}, Usages: []string{"digital signature", "client auth"}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		duration    time.Duration
+		usages      []certmanager.KeyUsage
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "annotation",
+			annotations: map[string]string{api.ProfileAnnotation: "shortLived"},
+			duration:    365 * day,
+			want:        "shortLived",
+		},
+		{
+			name:        "forbidden annotation",
+			annotations: map[string]string{api.ProfileAnnotation: "caIPAuserCert"},
+			wantErr:     true,
+		},
+		{
+			name:     "short duration",
+			duration: 7 * day,
+			want:     "shortLived",
+		},
+		{
+			name: "default duration and usages",
+			want: "serverCert",
+		},
+		{
+			name:     "client usages",
+			duration: 90 * day,
+			usages:   []certmanager.KeyUsage{certmanager.UsageDigitalSignature, certmanager.UsageClientAuth},
+			want:     "clientCert",
+		},
+		{
+			name:     "duration too long",
+			duration: 2 * 365 * day,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown usages",
+			duration: 90 * day,
+			usages:   []certmanager.KeyUsage{certmanager.UsageCodeSigning},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &FreeIPAPKI{spec: spec}
+
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Usages: tt.usages}}
+			cr.Annotations = tt.annotations
+			if tt.duration != 0 {
+				cr.Spec.Duration = &metav1.Duration{Duration: tt.duration}
+			}
+
+			got, err := p.profile(cr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("profile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var profileErr *ProfileError
+			if err != nil && !errors.As(err, &profileErr) {
+				t.Errorf("profile() error = %v, want a ProfileError", err)
+			}
+			if got != tt.want {
+				t.Errorf("profile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+)
+
+// DefaultClusterName is the name of the cluster of the provisioners built by
+// New.
+const DefaultClusterName = "default"
+
+const descriptionPrefix = "Managed by freeipa-issuer"
+
+// ownerDescription is the description of the hosts created for a
+// CertificateRequest. It names the cluster of the provisioner, so that
+// several clusters can share a FreeIPA domain.
+func (s *FreeIPAPKI) ownerDescription(cr *certmanager.CertificateRequest) string {
+	return fmt.Sprintf("%s cluster=%s namespace=%s certificaterequest=%s", descriptionPrefix, s.clusterName, cr.Namespace, cr.Name)
+}
+
+// owns reports whether a description tells that the entry was created for
+// the cluster of the provisioner.
+func (s *FreeIPAPKI) owns(description *string) bool {
+	owner := fmt.Sprintf("%s cluster=%s ", descriptionPrefix, s.clusterName)
+
+	return description != nil && strings.HasPrefix(*description, owner)
+}
+
+// NotManagedError means that a FreeIPA entry is no longer the one the issuer
+// created, so it must not be deleted.
+type NotManagedError struct {
+	msg string
+}
+
+func (e *NotManagedError) Error() string {
+	return e.msg
+}
+
+// Delete removes a host, a service, a principal alias or a DNS record created
+// by the issuer from FreeIPA. Entries already gone are ignored. Hosts whose
+// description no longer tells they belong to this cluster are kept and a
+// NotManagedError is returned. FreeIPA services have no description, so they
+// are kept likewise when their host does not belong to this cluster.
+func (s *FreeIPAPKI) Delete(ctx context.Context, entry api.ManagedEntry) error {
+	return s.call(func(client *freeipa.Client) error {
+		var err error
+		switch entry.Kind {
+		case api.ManagedEntryHost:
+			var host *freeipa.HostShowResult
+			host, err = client.HostShow(&freeipa.HostShowArgs{Fqdn: entry.Name}, &freeipa.HostShowOptionalArgs{})
+			if err == nil {
+				if !s.owns(host.Result.Description) {
+					return &NotManagedError{fmt.Sprintf("host %s is not managed by the issuer any more", entry.Name)}
+				}
+				_, err = client.HostDel(&freeipa.HostDelArgs{Fqdn: []string{entry.Name}}, &freeipa.HostDelOptionalArgs{})
+			}
+		case api.ManagedEntryService:
+			var p principal
+			p, err = parsePrincipal(entry.Name)
+			if err != nil {
+				return err
+			}
+			var host *freeipa.HostShowResult
+			host, err = client.HostShow(&freeipa.HostShowArgs{Fqdn: p.instance}, &freeipa.HostShowOptionalArgs{})
+			if err == nil {
+				if !s.owns(host.Result.Description) {
+					return &NotManagedError{fmt.Sprintf("host of service %s is not managed by the issuer", entry.Name)}
+				}
+				_, err = client.ServiceDel(&freeipa.ServiceDelArgs{Krbcanonicalname: []string{entry.Name}}, &freeipa.ServiceDelOptionalArgs{})
+			}
+		case api.ManagedEntryPrincipalAlias:
+			err = removePrincipalAlias(client, entry.Principal, entry.Name)
+		case api.ManagedEntryDNSRecord:
+			err = deleteDNSRecord(client, entry)
+		default:
+			return fmt.Errorf("unknown kind %q of entry %s", entry.Kind, entry.Name)
+		}
+
+		var ipaErr *freeipa.Error
+		if errors.As(err, &ipaErr) && ipaErr.Code == freeipa.NotFoundCode {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("fail deleting %s %s: %w", strings.ToLower(string(entry.Kind)), entry.Name, err)
+		}
+
+		return nil
+	})
+}
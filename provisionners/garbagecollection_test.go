@@ -0,0 +1,162 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestDelete(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	d := ipa.handleDirectory()
+
+	d.hosts["www.example.test"] = true
+	d.descriptions["www.example.test"] = "Managed by freeipa-issuer cluster=default namespace=default certificaterequest=www"
+	d.hosts["admin.example.test"] = true
+	d.descriptions["admin.example.test"] = "Managed by freeipa-issuer cluster=other namespace=default certificaterequest=admin"
+	d.hosts["ipa.example.test"] = true
+	d.services["HTTP/www.example.test"] = []string{"HTTP/api.example.test"}
+	d.services["HTTP/admin.example.test"] = nil
+	d.services["HTTP/ipa.example.test"] = nil
+	d.hostAliases["www.example.test"] = []string{"host/api.example.test"}
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		entry          api.ManagedEntry
+		wantNotManaged bool
+		wantHost       bool
+		wantService    bool
+	}{
+		{
+			name:  "service alias",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/www.example.test"},
+		},
+		{
+			name:  "host alias",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryPrincipalAlias, Name: "host/api.example.test", Principal: "host/www.example.test"},
+		},
+		{
+			name:  "alias already removed",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryPrincipalAlias, Name: "HTTP/api.example.test", Principal: "HTTP/www.example.test"},
+		},
+		{
+			name:  "service",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/www.example.test"},
+		},
+		{
+			name:           "service of a host of another cluster",
+			entry:          api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/admin.example.test@EXAMPLE.TEST"},
+			wantNotManaged: true,
+			wantService:    true,
+		},
+		{
+			name:           "service of a host without description",
+			entry:          api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/ipa.example.test"},
+			wantNotManaged: true,
+			wantService:    true,
+		},
+		{
+			name:  "service of a deleted host",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryService, Name: "HTTP/gone.example.test"},
+		},
+		{
+			name:  "host",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "www.example.test"},
+		},
+		{
+			name:  "already deleted",
+			entry: api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "gone.example.test"},
+		},
+		{
+			name:           "host of another cluster",
+			entry:          api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "admin.example.test"},
+			wantNotManaged: true,
+			wantHost:       true,
+		},
+		{
+			name:           "host without description",
+			entry:          api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "ipa.example.test"},
+			wantNotManaged: true,
+			wantHost:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Delete(context.Background(), tt.entry)
+
+			var notManaged *NotManagedError
+			if errors.As(err, &notManaged) != tt.wantNotManaged {
+				t.Fatalf("Delete() error = %v, want not managed %v", err, tt.wantNotManaged)
+			}
+			if !tt.wantNotManaged && err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+
+			if tt.entry.Kind == api.ManagedEntryPrincipalAlias {
+				aliases := d.services[tt.entry.Principal]
+				if fqdn := strings.TrimPrefix(tt.entry.Principal, "host/"); fqdn != tt.entry.Principal {
+					aliases = d.hostAliases[fqdn]
+				}
+				for _, alias := range aliases {
+					if alias == tt.entry.Name {
+						t.Errorf("alias %s of %s not removed", tt.entry.Name, tt.entry.Principal)
+					}
+				}
+			}
+			if tt.entry.Kind == api.ManagedEntryService {
+				name := strings.TrimSuffix(tt.entry.Name, "@EXAMPLE.TEST")
+				if _, ok := d.services[name]; ok != tt.wantService {
+					t.Errorf("service %s exists = %v, want %v", name, ok, tt.wantService)
+				}
+			}
+			if tt.entry.Kind == api.ManagedEntryHost && d.hosts[tt.entry.Name] != tt.wantHost {
+				t.Errorf("host %s exists = %v, want %v", tt.entry.Name, d.hosts[tt.entry.Name], tt.wantHost)
+			}
+		})
+	}
+
+	if _, ok := d.services["HTTP/www.example.test"]; ok {
+		t.Errorf("service HTTP/www.example.test not deleted")
+	}
+}
+
+func TestDelete_clusterName(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	d := ipa.handleDirectory()
+
+	d.hosts["www.example.test"] = true
+	d.descriptions["www.example.test"] = "Managed by freeipa-issuer cluster=default namespace=default certificaterequest=www"
+	d.hosts["api.example.test"] = true
+	d.descriptions["api.example.test"] = "Managed by freeipa-issuer cluster=prod namespace=default certificaterequest=api"
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true}
+	p, err := NewRegistry("prod").New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var notManaged *NotManagedError
+	if err := p.Delete(context.Background(), api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "www.example.test"}); !errors.As(err, &notManaged) {
+		t.Errorf("Delete() of a host of another cluster error = %v, want NotManagedError", err)
+	}
+	if err := p.Delete(context.Background(), api.ManagedEntry{Kind: api.ManagedEntryHost, Name: "api.example.test"}); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if !d.hosts["www.example.test"] || d.hosts["api.example.test"] {
+		t.Errorf("hosts = %v, want only www.example.test", d.hosts)
+	}
+}
@@ -0,0 +1,127 @@
+package provisioners
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// inFlightSkew is the clock skew allowed between the controller, which
+// records when a signing attempt started, and the FreeIPA CA, which sets the
+// start of the validity of the certificates it issues.
+const inFlightSkew = 5 * time.Minute
+
+// findIssued returns the serial number and the certificate FreeIPA issued
+// for the principal since a signing attempt started, give or take the clock
+// skew, with the public key, the common name and the alternative names of the
+// request. Revoked certificates are skipped.
+func (s *FreeIPAPKI) findIssued(ctx context.Context, client *freeipa.Client, p principal, csr *x509.CertificateRequest, since time.Time) (int, string, bool, error) {
+	log := log.FromContext(ctx).WithName("sign").WithValues("principal", p.String())
+
+	want, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return 0, "", false, fmt.Errorf("failed to encode public key of the request: %v", err)
+	}
+
+	opts := &freeipa.CertFindOptionalArgs{Cacn: &s.spec.Ca, All: freeipa.Bool(true)}
+	switch {
+	case p.isUser():
+		opts.User = &[]string{p.primary}
+	case p.isHost():
+		opts.Host = &[]string{p.instance}
+	default:
+		opts.Service = &[]string{p.String()}
+	}
+
+	res, err := client.CertFind("", &freeipa.CertFindArgs{}, opts)
+	if err != nil {
+		return 0, "", false, fmt.Errorf("fail finding certificates of %s: %w", p, err)
+	}
+
+	for _, c := range res.Result {
+		if c.Revoked != nil && *c.Revoked {
+			continue
+		}
+
+		der, _ := c.Certificate.(string)
+		cert, err := pki.DecodeX509CertificateBytes([]byte(formatCertificate(der)))
+		if err != nil {
+			log.V(1).Info("skipping undecodable certificate", "serial", c.SerialNumber, "error", err.Error())
+			continue
+		}
+		if cert.NotBefore.Before(since.Add(-inFlightSkew)) || !matchRequest(cert, csr) {
+			continue
+		}
+
+		got, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		if err == nil && bytes.Equal(got, want) {
+			return c.SerialNumber, der, true, nil
+		}
+	}
+
+	return 0, "", false, nil
+}
+
+// matchRequest reports whether the certificate has the common name and the
+// alternative names of the request. The rest of the subject is set by the
+// FreeIPA profile, and the common name may be added to the DNS names.
+func matchRequest(cert *x509.Certificate, csr *x509.CertificateRequest) bool {
+	if !strings.EqualFold(cert.Subject.CommonName, csr.Subject.CommonName) {
+		return false
+	}
+
+	var certIPs, csrIPs []string
+	for _, ip := range cert.IPAddresses {
+		certIPs = append(certIPs, ip.String())
+	}
+	for _, ip := range csr.IPAddresses {
+		csrIPs = append(csrIPs, ip.String())
+	}
+
+	var certURIs, csrURIs []string
+	for _, uri := range cert.URIs {
+		certURIs = append(certURIs, uri.String())
+	}
+	for _, uri := range csr.URIs {
+		csrURIs = append(csrURIs, uri.String())
+	}
+
+	certNames := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	csrNames := append([]string{csr.Subject.CommonName}, csr.DNSNames...)
+
+	return sameNames(certNames, csrNames) && sameNames(certIPs, csrIPs) &&
+		sameNames(cert.EmailAddresses, csr.EmailAddresses) && sameNames(certURIs, csrURIs)
+}
+
+// sameNames reports whether the lists hold the same non-empty names,
+// ignoring the case, the order and duplicates.
+func sameNames(a, b []string) bool {
+	set := func(names []string) map[string]bool {
+		m := map[string]bool{}
+		for _, name := range names {
+			if name != "" {
+				m[strings.ToLower(name)] = true
+			}
+		}
+		return m
+	}
+
+	as, bs := set(a), set(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for name := range as {
+		if !bs[name] {
+			return false
+		}
+	}
+
+	return true
+}
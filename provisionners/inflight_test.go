@@ -0,0 +1,211 @@
+package provisioners
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestSign_inFlight(t *testing.T) {
+	tests := []struct {
+		name        string
+		since       *time.Time
+		leafKey     bool
+		dnsNames    []string
+		revoked     bool
+		wantRequest bool
+	}{
+		{
+			name:        "first attempt",
+			leafKey:     true,
+			wantRequest: true,
+		},
+		{
+			name:    "issued by previous attempt",
+			since:   timePtr(time.Now().Add(-2 * time.Hour)),
+			leafKey: true,
+		},
+		{
+			name:     "issued with the same names",
+			since:    timePtr(time.Now().Add(-2 * time.Hour)),
+			leafKey:  true,
+			dnsNames: []string{"WWW.example.test"},
+		},
+		{
+			name:        "issued with other names",
+			since:       timePtr(time.Now().Add(-2 * time.Hour)),
+			leafKey:     true,
+			dnsNames:    []string{"www.example.test", "api.example.test"},
+			wantRequest: true,
+		},
+		{
+			name:        "other public key",
+			since:       timePtr(time.Now().Add(-2 * time.Hour)),
+			wantRequest: true,
+		},
+		{
+			name:    "issued by previous attempt with clock skew",
+			since:   timePtr(time.Now().Add(-time.Hour + 2*time.Minute)),
+			leafKey: true,
+		},
+		{
+			name:        "issued before the attempt",
+			since:       timePtr(time.Now()),
+			leafKey:     true,
+			wantRequest: true,
+		},
+		{
+			name:        "revoked",
+			since:       timePtr(time.Now().Add(-2 * time.Hour)),
+			leafKey:     true,
+			revoked:     true,
+			wantRequest: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+			ipa.handleDirectory()
+
+			var service interface{}
+			ipa.handle("cert_find", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+				service = options["service"]
+				return map[string]interface{}{"count": 1, "truncated": false, "result": []interface{}{map[string]interface{}{
+					"certificate":        ipa.chain.leaf,
+					"subject":            "CN=www.example.test",
+					"issuer":             "CN=team-ca",
+					"serial_number":      []interface{}{"3"},
+					"serial_number_hex":  "0x3",
+					"valid_not_before":   []interface{}{map[string]interface{}{"__datetime__": "20240101000000Z"}},
+					"valid_not_after":    []interface{}{map[string]interface{}{"__datetime__": "20250101000000Z"}},
+					"sha1_fingerprint":   "00",
+					"sha256_fingerprint": "00",
+					"status":             "VALID",
+					"revoked":            tt.revoked,
+					"revocation_reason":  []interface{}{"0"},
+				}}}, nil
+			})
+
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: "HTTP", AddHost: true, AddService: true, AddPrincipal: true, Ca: "ipa"}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			request := newCSR(t, "www.example.test")
+			if tt.leafKey {
+				der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.test"}, DNSNames: tt.dnsNames}, ipa.chain.leafKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+			}
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: request}}
+			if tt.since != nil {
+				cr.Annotations = map[string]string{api.InFlightAnnotation: tt.since.UTC().Format(time.RFC3339)}
+			}
+
+			cert, _, _, err := p.Sign(context.Background(), cr)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			if want := ipa.chain.pem(t, ipa.chain.leaf, ipa.chain.intermediate); string(cert) != want {
+				t.Errorf("Sign() cert = %q, want %q", cert, want)
+			}
+
+			requested := false
+			for _, method := range ipa.called() {
+				requested = requested || method == "cert_request"
+			}
+			if requested != tt.wantRequest {
+				t.Errorf("certificate requested = %v, want %v", requested, tt.wantRequest)
+			}
+			if services, _ := service.([]interface{}); tt.since != nil && (len(services) != 1 || services[0] != "HTTP/www.example.test") {
+				t.Errorf("cert_find service = %v, want HTTP/www.example.test", service)
+			}
+		})
+	}
+}
+
+func TestSign_inFlightFailover(t *testing.T) {
+	defer func(c clock.Clock) { Clock = c }(Clock)
+	// The attempt starts when the certificate of the fake chain was issued.
+	Clock = clocktesting.NewFakeClock(time.Now().Add(-time.Hour))
+
+	first := newFakeIPA(t)
+	second := newFakeIPA(t)
+	for _, ipa := range []*fakeIPA{first, second} {
+		ipa.user = "admin"
+		ipa.password = "secret"
+		ipa.chain = first.chain
+		ipa.handleDirectory()
+		ipa.handle("cert_find", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+			return map[string]interface{}{"count": 1, "truncated": false, "result": []interface{}{map[string]interface{}{
+				"certificate":        first.chain.leaf,
+				"subject":            "CN=www.example.test",
+				"issuer":             "CN=team-ca",
+				"serial_number":      []interface{}{"3"},
+				"serial_number_hex":  "0x3",
+				"valid_not_before":   []interface{}{map[string]interface{}{"__datetime__": "20240101000000Z"}},
+				"valid_not_after":    []interface{}{map[string]interface{}{"__datetime__": "20250101000000Z"}},
+				"sha1_fingerprint":   "00",
+				"sha256_fingerprint": "00",
+				"status":             "VALID",
+				"revoked":            false,
+				"revocation_reason":  []interface{}{"0"},
+			}}}, nil
+		})
+	}
+	// The first server issues the certificate, but the connection is reset
+	// before it answers.
+	first.handle("cert_request", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		first.CloseClientConnections()
+		return nil, nil
+	})
+
+	spec := &api.IssuerSpec{Hosts: []string{first.host(), second.host()}, Insecure: true, ServiceName: "HTTP", AddHost: true, AddService: true, AddPrincipal: true, Ca: "ipa"}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.test"}}, first.chain.leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})}}
+
+	cert, _, _, err := p.Sign(context.Background(), cr)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if want := first.chain.pem(t, first.chain.leaf, first.chain.intermediate); string(cert) != want {
+		t.Errorf("Sign() cert = %q, want %q", cert, want)
+	}
+
+	// The second server finds the certificate instead of issuing another one.
+	requested := map[string]bool{}
+	for _, method := range second.called() {
+		requested[method] = true
+	}
+	if !requested["cert_find"] || requested["cert_request"] {
+		t.Errorf("second server calls = %v, want cert_find and no cert_request", second.called())
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,99 @@
+package provisioners
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// connectWithKeytab logs in to a FreeIPA server with Kerberos, using the keys
+// from the keytab. The Kerberos client gets and renews its tickets by itself
+// and the FreeIPA client logs in again when its session expires.
+// KDCs default to the FreeIPA servers.
+func connectWithKeytab(spec *api.IssuerSpec, host string, servers []string, tspt *http.Transport, creds *Credentials) (*freeipa.Client, error) {
+	kt := keytab.New()
+	if err := kt.Unmarshal(creds.Keytab); err != nil {
+		return nil, fmt.Errorf("failed to parse keytab: %v", err)
+	}
+
+	username, realm, err := keytabPrincipal(kt, creds.User, spec.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	kdcs := spec.KDCs
+	if len(kdcs) == 0 {
+		for _, server := range servers {
+			if h, _, err := net.SplitHostPort(server); err == nil {
+				server = h
+			}
+			kdcs = append(kdcs, server)
+		}
+	}
+
+	return freeipa.ConnectWithKerberos(host, tspt, &freeipa.KerberosConnectOptions{
+		Krb5ConfigReader: strings.NewReader(krb5Config(realm, kdcs)),
+		KeytabReader:     bytes.NewReader(creds.Keytab),
+		Username:         username,
+		Realm:            realm,
+	})
+}
+
+// keytabPrincipal returns the principal name and realm to log in with.
+// An explicit user ("name" or "name@REALM") and realm take precedence over
+// the first principal found in the keytab.
+func keytabPrincipal(kt *keytab.Keytab, user, realm string) (string, string, error) {
+	username := user
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		username = user[:i]
+		if realm == "" {
+			realm = user[i+1:]
+		}
+	}
+
+	for _, e := range kt.Entries {
+		name := strings.Join(e.Principal.Components, "/")
+		if username != "" && username != name {
+			continue
+		}
+		if realm != "" && realm != e.Principal.Realm {
+			continue
+		}
+
+		return name, e.Principal.Realm, nil
+	}
+
+	if username == "" {
+		username = "any principal"
+	}
+	if realm == "" {
+		realm = "any realm"
+	}
+
+	return "", "", fmt.Errorf("keytab has no key for %s in %s", username, realm)
+}
+
+// krb5Config generates a minimal krb5.conf for a single realm.
+func krb5Config(realm string, kdcs []string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "[libdefaults]\n")
+	fmt.Fprintf(&b, "  default_realm = %s\n", realm)
+	fmt.Fprintf(&b, "  dns_lookup_realm = false\n")
+	fmt.Fprintf(&b, "  dns_lookup_kdc = false\n")
+	fmt.Fprintf(&b, "  udp_preference_limit = 1\n")
+	fmt.Fprintf(&b, "\n[realms]\n")
+	fmt.Fprintf(&b, "  %s = {\n", realm)
+	for _, kdc := range kdcs {
+		fmt.Fprintf(&b, "    kdc = %s\n", kdc)
+	}
+	fmt.Fprintf(&b, "  }\n")
+
+	return b.String()
+}
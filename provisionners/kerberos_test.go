@@ -0,0 +1,104 @@
+package provisioners
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestConnectWithKeytab(t *testing.T) {
+	const realm = "EXAMPLE.TEST"
+
+	kdc := newFakeKDC(t, realm)
+	ipa := newFakeIPA(t)
+	ipa.keytab = kdc.addPrincipal(t, "HTTP/127.0.0.1", "http-secret")
+
+	kt := kdc.addPrincipal(t, "issuer/k8s.example.test", "issuer-secret")
+	ktBytes, err := kt.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal keytab: %v", err)
+	}
+
+	ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"summary": "IPA server version 4.9.8. API version 2.245"}, nil
+	})
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, KDCs: []string{kdc.addr()}}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{Keytab: ktBytes})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := p.call(func(c *freeipa.Client) error {
+		_, err := c.Ping(&freeipa.PingArgs{}, &freeipa.PingOptionalArgs{})
+		return err
+	}); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
+
+func Test_keytabPrincipal(t *testing.T) {
+	kt := keytab.New()
+	for _, e := range []struct{ name, realm string }{
+		{"issuer/k8s.example.test", "EXAMPLE.TEST"},
+		{"admin", "EXAMPLE.TEST"},
+		{"admin", "OTHER.TEST"},
+	} {
+		if err := kt.AddEntry(e.name, e.realm, "secret", time.Now(), 1, fakeKDCEtype); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		user      string
+		realm     string
+		wantName  string
+		wantRealm string
+		wantErr   bool
+	}{
+		{
+			name:      "first principal",
+			wantName:  "issuer/k8s.example.test",
+			wantRealm: "EXAMPLE.TEST",
+		},
+		{
+			name:      "user",
+			user:      "admin",
+			wantName:  "admin",
+			wantRealm: "EXAMPLE.TEST",
+		},
+		{
+			name:      "user with realm",
+			user:      "admin@OTHER.TEST",
+			wantName:  "admin",
+			wantRealm: "OTHER.TEST",
+		},
+		{
+			name:      "realm",
+			realm:     "OTHER.TEST",
+			wantName:  "admin",
+			wantRealm: "OTHER.TEST",
+		},
+		{
+			name:    "unknown user",
+			user:    "nobody",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotName, gotRealm, err := keytabPrincipal(kt, tt.user, tt.realm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("keytabPrincipal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotName != tt.wantName || gotRealm != tt.wantRealm {
+				t.Errorf("keytabPrincipal() = %v, %v, want %v, %v", gotName, gotRealm, tt.wantName, tt.wantRealm)
+			}
+		})
+	}
+}
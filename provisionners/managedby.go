@@ -0,0 +1,30 @@
+package provisioners
+
+import (
+	"fmt"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+)
+
+// addManagedBy makes a host managed by another one, which FreeIPA then lets
+// request certificates for it. Hosts already managed by it are skipped.
+func addManagedBy(client *freeipa.Client, host, manager string) error {
+	res, err := client.HostAddManagedby(&freeipa.HostAddManagedbyArgs{
+		Fqdn: host,
+	}, &freeipa.HostAddManagedbyOptionalArgs{
+		Host: &[]string{manager},
+	})
+	if err != nil {
+		return fmt.Errorf("fail adding %s as manager of host %s: %w", manager, host, err)
+	}
+
+	for _, ops := range res.Failed.GetFailures() {
+		for _, op := range ops {
+			if op.Reason != freeipa.FailedReasonAlreadyAMember {
+				return fmt.Errorf("fail adding %s as manager of host %s: %s", manager, host, op.Reason)
+			}
+		}
+	}
+
+	return nil
+}
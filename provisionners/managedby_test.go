@@ -0,0 +1,45 @@
+package provisioners
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSign_managedBy(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	d := ipa.handleDirectory()
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: "HTTP", AddManagedBy: true, AddPrincipal: true, Ca: "ipa"}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: newCSR(t, "www.example.test", "api.example.test", "static.example.test")}}
+	cr.Namespace, cr.Name = "default", "www"
+
+	// Signing again finds the hosts already managed.
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := p.Sign(context.Background(), cr); err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+	}
+
+	want := map[string][]string{
+		"api.example.test":    {"www.example.test"},
+		"static.example.test": {"www.example.test"},
+	}
+	if !reflect.DeepEqual(d.managedBy, want) {
+		t.Errorf("managed by = %v, want %v", d.managedBy, want)
+	}
+	if !d.hosts["www.example.test"] || !d.hosts["api.example.test"] || !d.hosts["static.example.test"] {
+		t.Errorf("hosts = %v, want the hosts of every DNS name", d.hosts)
+	}
+}
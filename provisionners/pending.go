@@ -0,0 +1,91 @@
+package provisioners
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// PendingError means that FreeIPA holds the certificate request until a CA
+// agent approves it.
+type PendingError struct {
+	RequestID int
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("certificate request %d waits for the approval of a CA agent", e.RequestID)
+}
+
+// RejectedError means that a CA agent rejected or canceled the certificate
+// request.
+type RejectedError struct {
+	msg string
+}
+
+func (e *RejectedError) Error() string {
+	return e.msg
+}
+
+// requestStatus returns the certificate of a request once a CA agent approved
+// it, a PendingError while it waits for approval, and a RejectedError when it
+// is rejected or canceled.
+func (s *FreeIPAPKI) requestStatus(ctx context.Context, client *freeipa.Client, id int) (string, string, error) {
+	log := log.FromContext(ctx).WithName("sign").WithValues("requestID", id)
+
+	status, err := client.CertStatus(&freeipa.CertStatusArgs{RequestID: id}, &freeipa.CertStatusOptionalArgs{Cacn: &s.spec.Ca})
+	if err != nil {
+		return "", "", fmt.Errorf("fail getting status of certificate request %d: %w", id, err)
+	}
+
+	res, _ := status.Result.(map[string]interface{})
+	state, _ := res["cert_request_status"].(string)
+	log.V(1).Info("certificate request status", "status", state)
+
+	switch state {
+	case "complete":
+		serial, ok := serialNumber(res["serial_number"])
+		if !ok {
+			return "", "", fmt.Errorf("certificate request %d is complete without serial number", id)
+		}
+		return s.showCertificate(ctx, client, serial, "")
+	case "rejected", "canceled":
+		return "", "", &RejectedError{fmt.Sprintf("certificate request %d is %s", id, state)}
+	default:
+		return "", "", &PendingError{RequestID: id}
+	}
+}
+
+// serialNumber returns the serial number of a FreeIPA result, given as a
+// number or a string.
+func serialNumber(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), n > 0
+	case string:
+		serial, err := strconv.ParseInt(n, 0, 64)
+		return int(serial), err == nil && serial > 0
+	case []interface{}:
+		if len(n) == 1 {
+			return serialNumber(n[0])
+		}
+	}
+
+	return 0, false
+}
+
+// requestID returns the ID of a certificate request of a FreeIPA result,
+// given as a number or a string.
+func requestID(v interface{}) (int, bool) {
+	switch id := v.(type) {
+	case float64:
+		return int(id), true
+	case string:
+		n, err := strconv.Atoi(id)
+		return n, err == nil
+	}
+
+	return 0, false
+}
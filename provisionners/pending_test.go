@@ -0,0 +1,93 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSign_pending(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	ipa.handleDirectory()
+
+	ipa.handle("cert_request", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"value": 0, "result": map[string]interface{}{"request_id": "7", "cert_request_status": "pending"}}, nil
+	})
+	status := "pending"
+	ipa.handle("cert_status", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		if options["request_id"] != float64(7) {
+			return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "request not found"}
+		}
+		result := map[string]interface{}{"request_id": "7", "cert_request_status": status}
+		if status == "complete" {
+			result["serial_number"] = 1
+		}
+		return map[string]interface{}{"value": 7, "result": result}, nil
+	})
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: "HTTP", AddHost: true, AddService: true, AddPrincipal: true, Ca: "ipa"}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: newCSR(t, "www.example.test")}}
+
+	_, _, _, err = p.Sign(context.Background(), cr)
+	var pendingErr *PendingError
+	if !errors.As(err, &pendingErr) || pendingErr.RequestID != 7 {
+		t.Fatalf("Sign() error = %v, want pending request 7", err)
+	}
+
+	cr.Annotations = map[string]string{api.RequestIDAnnotation: "7"}
+
+	if _, _, _, err := p.Sign(context.Background(), cr); !errors.As(err, &pendingErr) {
+		t.Errorf("Sign() of pending request error = %v, want pending", err)
+	}
+
+	status = "complete"
+	cert, ca, _, err := p.Sign(context.Background(), cr)
+	if err != nil {
+		t.Fatalf("Sign() of complete request error = %v", err)
+	}
+	if string(cert) != ipa.chain.pem(t, ipa.chain.leaf, ipa.chain.intermediate) || string(ca) != ipa.chain.pem(t, ipa.chain.root) {
+		t.Errorf("Sign() = %q, %q", cert, ca)
+	}
+
+	status = "rejected"
+	var rejectedErr *RejectedError
+	if _, _, _, err := p.Sign(context.Background(), cr); !errors.As(err, &rejectedErr) {
+		t.Errorf("Sign() of rejected request error = %v, want rejected", err)
+	}
+}
+
+func Test_serialNumber(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      interface{}
+		want   int
+		wantOk bool
+	}{
+		{name: "number", v: float64(12), want: 12, wantOk: true},
+		{name: "string", v: "12", want: 12, wantOk: true},
+		{name: "hex string", v: "0xc", want: 12, wantOk: true},
+		{name: "list", v: []interface{}{"12"}, want: 12, wantOk: true},
+		{name: "missing", v: nil},
+		{name: "invalid", v: "serial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := serialNumber(tt.v)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("serialNumber() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
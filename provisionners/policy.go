@@ -0,0 +1,148 @@
+package provisioners
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+)
+
+// PolicyError means that a certificate request breaks the policy of the
+// issuer.
+type PolicyError struct {
+	msg string
+}
+
+func (e *PolicyError) Error() string {
+	return e.msg
+}
+
+// validatePolicy checks the syntax of a policy.
+func validatePolicy(policy *api.Policy) error {
+	if policy == nil {
+		return nil
+	}
+
+	for _, r := range policy.AllowedIPRanges {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return fmt.Errorf("invalid allowed IP range %q: %v", r, err)
+		}
+	}
+
+	return nil
+}
+
+// checkPolicy checks the DNS names, the IP addresses and the principal of a
+// request against the policy of the issuer. The host of the principal is
+// checked as a DNS name, as it may come from the annotations of the request
+// and be added to FreeIPA. User principals have no host nor service name.
+func (s *FreeIPAPKI) checkPolicy(csr *x509.CertificateRequest, principal principal) error {
+	policy := s.spec.Policy
+	if policy == nil {
+		return nil
+	}
+
+	if err := s.checkNamePolicy(csr); err != nil {
+		return err
+	}
+
+	if !principal.isUser() {
+		if err := checkDNSName(policy, principal.instance); err != nil {
+			return err
+		}
+	}
+
+	if len(policy.AllowedServiceNames) > 0 {
+		if principal.isUser() {
+			return &PolicyError{fmt.Sprintf("user principal %q is not allowed by the issuer", principal)}
+		}
+
+		allowed := false
+		for _, name := range policy.AllowedServiceNames {
+			if name == principal.primary {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{fmt.Sprintf("service name %q is not allowed by the issuer", principal.primary)}
+		}
+	}
+
+	return nil
+}
+
+// checkNamePolicy checks the DNS names and the IP addresses of a request
+// against the policy of the issuer.
+func (s *FreeIPAPKI) checkNamePolicy(csr *x509.CertificateRequest) error {
+	policy := s.spec.Policy
+	if policy == nil {
+		return nil
+	}
+
+	for _, host := range hostnames(csr) {
+		if err := checkDNSName(policy, host); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range csr.IPAddresses {
+		if !inRanges(policy.AllowedIPRanges, ip) {
+			return &PolicyError{fmt.Sprintf("IP address %s is not allowed by the issuer", ip)}
+		}
+	}
+
+	return nil
+}
+
+// checkDNSName checks a DNS name against the policy.
+func checkDNSName(policy *api.Policy, host string) error {
+	for _, pattern := range policy.DeniedDNSNames {
+		if matchDNSName(pattern, host) {
+			return &PolicyError{fmt.Sprintf("DNS name %q is denied by the issuer", host)}
+		}
+	}
+	if len(policy.AllowedDNSNames) > 0 && !matchDNSNames(policy.AllowedDNSNames, host) {
+		return &PolicyError{fmt.Sprintf("DNS name %q is not allowed by the issuer", host)}
+	}
+
+	return nil
+}
+
+// matchDNSNames reports whether the name matches one of the patterns.
+func matchDNSNames(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchDNSName(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDNSName reports whether the name matches the pattern, ignoring the
+// case. A pattern *.example.com matches every name under example.com, but
+// not example.com itself.
+func matchDNSName(pattern, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+
+	return name == pattern
+}
+
+// inRanges reports whether the IP address is in one of the CIDRs.
+func inRanges(ranges []string, ip net.IP) bool {
+	for _, r := range ranges {
+		if _, ipNet, err := net.ParseCIDR(r); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,160 @@
+package provisioners
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"testing"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSign_policy(t *testing.T) {
+	policy := &api.Policy{
+		AllowedDNSNames:     []string{"*.example.test"},
+		DeniedDNSNames:      []string{"admin.example.test"},
+		AllowedServiceNames: []string{"HTTP"},
+		AllowedIPRanges:     []string{"10.0.0.0/8"},
+	}
+
+	tests := []struct {
+		name          string
+		serviceName   string
+		principal     string
+		annotations   map[string]string
+		commonName    string
+		dnsNames      []string
+		ips           []net.IP
+		wantPolicyErr bool
+	}{
+		{
+			name:        "allowed",
+			serviceName: "HTTP",
+			commonName:  "www.example.test",
+			dnsNames:    []string{"WWW.Example.Test", "api.example.test"},
+			ips:         []net.IP{net.ParseIP("10.1.2.3")},
+		},
+		{
+			name:          "DNS name not allowed",
+			serviceName:   "HTTP",
+			commonName:    "www.example.test",
+			dnsNames:      []string{"www.other.test"},
+			wantPolicyErr: true,
+		},
+		{
+			name:          "domain itself",
+			serviceName:   "HTTP",
+			commonName:    "example.test",
+			wantPolicyErr: true,
+		},
+		{
+			name:          "DNS name denied",
+			serviceName:   "HTTP",
+			commonName:    "admin.example.test",
+			wantPolicyErr: true,
+		},
+		{
+			name:        "principal host allowed",
+			principal:   `HTTP/{{ index .Annotations "example.test/host" }}`,
+			annotations: map[string]string{"example.test/host": "api.example.test"},
+			commonName:  "www.example.test",
+		},
+		{
+			name:          "principal host denied",
+			principal:     `HTTP/{{ index .Annotations "example.test/host" }}`,
+			annotations:   map[string]string{"example.test/host": "admin.example.test"},
+			commonName:    "www.example.test",
+			wantPolicyErr: true,
+		},
+		{
+			name:          "principal host not allowed",
+			principal:     `HTTP/{{ index .Annotations "example.test/host" }}`,
+			annotations:   map[string]string{"example.test/host": "www.other.test"},
+			commonName:    "www.example.test",
+			wantPolicyErr: true,
+		},
+		{
+			name:          "service name not allowed",
+			serviceName:   "ldap",
+			commonName:    "www.example.test",
+			wantPolicyErr: true,
+		},
+		{
+			name:          "IP address not allowed",
+			serviceName:   "HTTP",
+			commonName:    "www.example.test",
+			ips:           []net.IP{net.ParseIP("192.168.1.1")},
+			wantPolicyErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+			ipa.handleDirectory()
+
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: tt.serviceName, Principal: tt.principal, AddHost: true, AddService: true, AddPrincipal: true, Ca: "ipa", Policy: policy}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			login := len(ipa.called())
+
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: newIPCSR(t, tt.commonName, tt.dnsNames, tt.ips)}}
+			cr.Annotations = tt.annotations
+			_, _, _, err = p.Sign(context.Background(), cr)
+
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) != tt.wantPolicyErr {
+				t.Fatalf("Sign() error = %v, want PolicyError %v", err, tt.wantPolicyErr)
+			}
+			if tt.wantPolicyErr {
+				if calls := ipa.called()[login:]; len(calls) > 0 {
+					t.Errorf("Sign() called FreeIPA %v for a denied request", calls)
+				}
+			} else if err != nil {
+				t.Errorf("Sign() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNew_invalidPolicy(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, Policy: &api.Policy{AllowedIPRanges: []string{"10.0.0.0"}}}
+	if _, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"}); err == nil {
+		t.Error("New() with invalid IP range succeeded")
+	}
+}
+
+func newIPCSR(t *testing.T, commonName string, dnsNames []string, ips []net.IP) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
@@ -0,0 +1,158 @@
+package provisioners
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"text/template"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+)
+
+// defaultPrincipal is the principal format of issuers setting none.
+const defaultPrincipal = "{{.ServiceName}}/{{.Host}}"
+
+// PrincipalError means that the principal of a certificate request can't be
+// built from the principal format of the issuer.
+type PrincipalError struct {
+	msg string
+}
+
+func (e *PrincipalError) Error() string {
+	return e.msg
+}
+
+// principalData is what a principal format can use.
+type principalData struct {
+	// CN common name of the request
+	CN string
+	// Host common name of the request, or its first DNS name without one
+	Host string
+	// DNSNames DNS names of the request
+	DNSNames []string
+	// ServiceName and Realm of the issuer
+	ServiceName string
+	Realm       string
+	// Namespace, Name and Annotations of the CertificateRequest
+	Namespace   string
+	Name        string
+	Annotations map[string]string
+}
+
+// principal is a Kerberos principal: primary/instance@REALM. User principals
+// have no instance, host principals have the primary "host".
+type principal struct {
+	primary  string
+	instance string
+	realm    string
+}
+
+func (p principal) String() string {
+	name := p.primary
+	if p.instance != "" {
+		name += "/" + p.instance
+	}
+	if p.realm != "" {
+		name += "@" + p.realm
+	}
+
+	return name
+}
+
+func (p principal) isUser() bool {
+	return p.instance == ""
+}
+
+func (p principal) isHost() bool {
+	return p.instance != "" && p.primary == "host"
+}
+
+// withInstance returns the principal of the same service and realm for
+// another host.
+func (p principal) withInstance(instance string) principal {
+	p.instance = instance
+	return p
+}
+
+// parsePrincipal parses a principal. An empty realm after the @ is dropped,
+// so that formats can end with @{{.Realm}} when the issuer has no realm.
+func parsePrincipal(name string) (principal, error) {
+	var p principal
+
+	rest := strings.TrimSpace(name)
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest, p.realm = rest[:i], rest[i+1:]
+	}
+	p.primary = rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		p.primary, p.instance = rest[:i], rest[i+1:]
+		if p.instance == "" || strings.Contains(p.instance, "/") {
+			return principal{}, fmt.Errorf("invalid principal %q", name)
+		}
+	}
+	if p.primary == "" || strings.ContainsAny(rest+p.realm, " @") {
+		return principal{}, fmt.Errorf("invalid principal %q", name)
+	}
+
+	return p, nil
+}
+
+// parsePrincipalFormat parses the principal format of an issuer, and checks
+// that it only uses fields of principalData. Annotations a request lacks are
+// an error when signing it.
+func parsePrincipalFormat(format string) (*template.Template, error) {
+	if format == "" {
+		format = defaultPrincipal
+	}
+
+	tmpl, err := template.New("principal").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid principal format: %v", err)
+	}
+
+	sample := principalData{
+		CN:          "www.example.com",
+		Host:        "www.example.com",
+		DNSNames:    []string{"www.example.com"},
+		ServiceName: "HTTP",
+		Realm:       "EXAMPLE.COM",
+		Namespace:   "default",
+		Name:        "example",
+	}
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, fmt.Errorf("invalid principal format: %v", err)
+	}
+
+	return tmpl.Option("missingkey=error"), nil
+}
+
+// principal returns the principal to request the certificate for.
+func (s *FreeIPAPKI) principal(cr *certmanager.CertificateRequest, csr *x509.CertificateRequest) (principal, error) {
+	data := principalData{
+		CN:          csr.Subject.CommonName,
+		DNSNames:    csr.DNSNames,
+		ServiceName: s.spec.ServiceName,
+		Realm:       s.spec.Realm,
+		Namespace:   cr.Namespace,
+		Name:        cr.Name,
+		Annotations: cr.Annotations,
+	}
+	if hosts := hostnames(csr); len(hosts) > 0 {
+		data.Host = hosts[0]
+	}
+	if data.Annotations == nil {
+		data.Annotations = map[string]string{}
+	}
+
+	var b strings.Builder
+	if err := s.principalFormat.Execute(&b, data); err != nil {
+		return principal{}, &PrincipalError{fmt.Sprintf("failed to format principal: %v", err)}
+	}
+
+	p, err := parsePrincipal(b.String())
+	if err != nil {
+		return principal{}, &PrincipalError{err.Error()}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,168 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSign_principal(t *testing.T) {
+	tests := []struct {
+		name             string
+		format           string
+		realm            string
+		annotations      map[string]string
+		wantPrincipal    string
+		wantHosts        []string
+		wantServices     map[string][]string
+		wantHostAliases  map[string][]string
+		wantPrincipalErr bool
+	}{
+		{
+			name:          "default",
+			wantPrincipal: "HTTP/www.example.test",
+			wantHosts:     []string{"api.example.test", "www.example.test"},
+			wantServices:  map[string][]string{"HTTP/www.example.test": {"HTTP/api.example.test"}},
+		},
+		{
+			name:          "annotation and realm",
+			format:        "{{.Annotations.service}}/{{.CN}}@{{.Realm}}",
+			realm:         "EXAMPLE.TEST",
+			annotations:   map[string]string{"service": "ldap"},
+			wantPrincipal: "ldap/www.example.test@EXAMPLE.TEST",
+			wantHosts:     []string{"api.example.test", "www.example.test"},
+			wantServices:  map[string][]string{"ldap/www.example.test@EXAMPLE.TEST": {"ldap/api.example.test@EXAMPLE.TEST"}},
+		},
+		{
+			name:          "empty realm",
+			format:        "{{.ServiceName}}/{{.CN}}@{{.Realm}}",
+			wantPrincipal: "HTTP/www.example.test",
+			wantHosts:     []string{"api.example.test", "www.example.test"},
+			wantServices:  map[string][]string{"HTTP/www.example.test": {"HTTP/api.example.test"}},
+		},
+		{
+			name:            "host principal",
+			format:          "host/{{.Host}}",
+			wantPrincipal:   "host/www.example.test",
+			wantHosts:       []string{"api.example.test", "www.example.test"},
+			wantServices:    map[string][]string{},
+			wantHostAliases: map[string][]string{"www.example.test": {"host/api.example.test"}},
+		},
+		{
+			name:          "user principal",
+			format:        "{{.Namespace}}-{{.Name}}",
+			wantPrincipal: "default-www",
+			wantServices:  map[string][]string{},
+		},
+		{
+			name:             "missing annotation",
+			format:           "{{.Annotations.service}}/{{.CN}}",
+			wantPrincipalErr: true,
+		},
+		{
+			name:             "invalid principal",
+			format:           "{{.ServiceName}}/",
+			wantPrincipalErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+			d := ipa.handleDirectory()
+
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, ServiceName: "HTTP", Principal: tt.format, Realm: tt.realm, AddHost: true, AddService: true, AddPrincipal: true, Ca: "ipa"}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: newCSR(t, "www.example.test", "api.example.test")}}
+			cr.Namespace, cr.Name = "default", "www"
+			cr.Annotations = tt.annotations
+			_, _, _, err = p.Sign(context.Background(), cr)
+
+			var principalErr *PrincipalError
+			if errors.As(err, &principalErr) != tt.wantPrincipalErr {
+				t.Fatalf("Sign() error = %v, want PrincipalError %v", err, tt.wantPrincipalErr)
+			}
+			if tt.wantPrincipalErr {
+				return
+			}
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+
+			if d.principal != tt.wantPrincipal {
+				t.Errorf("principal = %q, want %q", d.principal, tt.wantPrincipal)
+			}
+			var hosts []string
+			for host := range d.hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			if !reflect.DeepEqual(hosts, tt.wantHosts) {
+				t.Errorf("hosts = %v, want %v", hosts, tt.wantHosts)
+			}
+			if !reflect.DeepEqual(d.services, tt.wantServices) {
+				t.Errorf("services = %v, want %v", d.services, tt.wantServices)
+			}
+			if tt.wantHostAliases == nil {
+				tt.wantHostAliases = map[string][]string{}
+			}
+			if !reflect.DeepEqual(d.hostAliases, tt.wantHostAliases) {
+				t.Errorf("host aliases = %v, want %v", d.hostAliases, tt.wantHostAliases)
+			}
+		})
+	}
+}
+
+func TestNew_invalidPrincipal(t *testing.T) {
+	for _, format := range []string{"{{.ServiceName}/{{.Host}}", "{{.Service}}/{{.Host}}"} {
+		ipa := newFakeIPA(t)
+		ipa.user = "admin"
+		ipa.password = "secret"
+
+		spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, Principal: format}
+		_, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+		if Reason(err) != ReasonInvalidPrincipal {
+			t.Errorf("New() with principal %q error = %v, want %s", format, err, ReasonInvalidPrincipal)
+		}
+	}
+}
+
+func Test_parsePrincipal(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    principal
+		wantErr bool
+	}{
+		{name: "HTTP/www.example.test", want: principal{primary: "HTTP", instance: "www.example.test"}},
+		{name: "HTTP/www.example.test@EXAMPLE.TEST", want: principal{primary: "HTTP", instance: "www.example.test", realm: "EXAMPLE.TEST"}},
+		{name: "host/www.example.test@", want: principal{primary: "host", instance: "www.example.test"}},
+		{name: "alice", want: principal{primary: "alice"}},
+		{name: "/www.example.test", wantErr: true},
+		{name: "HTTP/", wantErr: true},
+		{name: "HTTP/www/example", wantErr: true},
+		{name: "HTTP/www@a@b", wantErr: true},
+		{name: "<no value>/www", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePrincipal(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrincipal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parsePrincipal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
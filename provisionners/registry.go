@@ -0,0 +1,263 @@
+package provisioners
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// BuildFunc builds the provisioner of an issuer, and returns the generation
+// of the spec it was built from.
+type BuildFunc func() (*FreeIPAPKI, int64, error)
+
+// entry is a provisioner of a Registry, with the generation of the spec of
+// the issuer it was built from.
+type entry struct {
+	provisioner *FreeIPAPKI
+	generation  int64
+	built       time.Time
+}
+
+// build is a provisioner being built by LoadOrBuild, which concurrent
+// callers wait for.
+type build struct {
+	done        chan struct{}
+	provisioner *FreeIPAPKI
+	err         error
+}
+
+// refusal is a spec and credentials FreeIPA refused to log in with.
+type refusal struct {
+	spec        *api.IssuerSpec
+	credentials [sha256.Size]byte
+	err         error
+}
+
+// Registry holds the provisioners of the Issuers and ClusterIssuers by
+// NamespacedName. It is a Runnable of the manager, which closes the
+// provisioners when it stops.
+type Registry struct {
+	mu       sync.RWMutex
+	entries  map[types.NamespacedName]entry
+	building map[types.NamespacedName]*build
+
+	// refused holds the last refused credentials of an issuer, which are
+	// not tried again, so that the account is not locked out.
+	refused map[types.NamespacedName]refusal
+
+	// clusterName names the cluster of the provisioners it builds
+	clusterName string
+}
+
+// NewRegistry returns an empty Registry for the named cluster.
+func NewRegistry(clusterName string) *Registry {
+	return &Registry{
+		entries:     map[types.NamespacedName]entry{},
+		building:    map[types.NamespacedName]*build{},
+		refused:     map[types.NamespacedName]refusal{},
+		clusterName: clusterName,
+	}
+}
+
+// New returns a new provisioner for the cluster of the Registry, without
+// storing it. When FreeIPA refused the same spec and credentials before, it
+// returns that error again without logging in.
+func (r *Registry) New(namespacedName types.NamespacedName, spec *api.IssuerSpec, creds *Credentials) (*FreeIPAPKI, error) {
+	fingerprint := creds.fingerprint()
+
+	r.mu.RLock()
+	f, ok := r.refused[namespacedName]
+	r.mu.RUnlock()
+	if ok && f.credentials == fingerprint && reflect.DeepEqual(f.spec, spec) {
+		return nil, fmt.Errorf("FreeIPA refused the credentials, not logging in again until they change: %w", f.err)
+	}
+
+	p, err := newProvisioner(namespacedName, spec, creds, r.clusterName)
+
+	r.mu.Lock()
+	if err != nil && isAuthError(err) {
+		r.refused[namespacedName] = refusal{spec: spec.DeepCopy(), credentials: fingerprint, err: err}
+	} else {
+		delete(r.refused, namespacedName)
+	}
+	r.mu.Unlock()
+
+	return p, err
+}
+
+// Start waits for the manager to stop, then closes the provisioners.
+func (r *Registry) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	r.mu.Lock()
+	entries := r.entries
+	r.entries = map[types.NamespacedName]entry{}
+	r.mu.Unlock()
+
+	for _, e := range entries {
+		e.provisioner.Close()
+	}
+
+	return nil
+}
+
+// NeedLeaderElection tells the manager to start the Registry on every
+// replica, as it holds the provisioners of all the controllers.
+func (r *Registry) NeedLeaderElection() bool {
+	return false
+}
+
+// Load returns a provisioner by NamespacedName.
+func (r *Registry) Load(namespacedName types.NamespacedName) (*FreeIPAPKI, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, ok := r.entries[namespacedName]
+	return e.provisioner, ok
+}
+
+// Generation returns the generation of the spec the provisioner of
+// NamespacedName was built from.
+func (r *Registry) Generation(namespacedName types.NamespacedName) (int64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, ok := r.entries[namespacedName]
+	return e.generation, ok
+}
+
+// LoadCurrent returns the provisioner of NamespacedName when it was built
+// from the given generation of the spec and the same credentials, so that it
+// can be used instead of logging in again.
+func (r *Registry) LoadCurrent(namespacedName types.NamespacedName, generation int64, creds *Credentials) (*FreeIPAPKI, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, ok := r.entries[namespacedName]
+	if !ok || e.generation != generation || e.provisioner.credentials != creds.fingerprint() {
+		return nil, false
+	}
+
+	return e.provisioner, true
+}
+
+// Store adds a new provisioner by NamespacedName, built from the given
+// generation of the spec. The provisioner it replaces is closed.
+func (r *Registry) Store(namespacedName types.NamespacedName, generation int64, provisioner *FreeIPAPKI) {
+	r.mu.Lock()
+	old, loaded := r.entries[namespacedName]
+	r.entries[namespacedName] = entry{provisioner: provisioner, generation: generation, built: Clock.Now()}
+	r.mu.Unlock()
+
+	if loaded && old.provisioner != provisioner {
+		old.provisioner.Close()
+	}
+}
+
+// LoadOrBuild returns the provisioner of NamespacedName, building and storing
+// it first when there is none. Concurrent callers wait for a single build
+// and share its result, unless their context is done first. When another
+// provisioner is stored while it builds one, the stored one is returned.
+func (r *Registry) LoadOrBuild(ctx context.Context, namespacedName types.NamespacedName, fn BuildFunc) (*FreeIPAPKI, error) {
+	r.mu.Lock()
+	if e, ok := r.entries[namespacedName]; ok {
+		r.mu.Unlock()
+		return e.provisioner, nil
+	}
+	if b, ok := r.building[namespacedName]; ok {
+		r.mu.Unlock()
+		select {
+		case <-b.done:
+			return b.provisioner, b.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	b := &build{done: make(chan struct{})}
+	r.building[namespacedName] = b
+	r.mu.Unlock()
+
+	defer close(b.done)
+
+	p, generation, err := fn()
+
+	r.mu.Lock()
+	delete(r.building, namespacedName)
+	e, loaded := r.entries[namespacedName]
+	if err == nil && !loaded {
+		r.entries[namespacedName] = entry{provisioner: p, generation: generation, built: Clock.Now()}
+	}
+	r.mu.Unlock()
+
+	switch {
+	case err != nil:
+		b.err = err
+	case loaded:
+		p.Close()
+		b.provisioner = e.provisioner
+	default:
+		b.provisioner = p
+	}
+
+	return b.provisioner, b.err
+}
+
+// Delete removes the provisioner of NamespacedName and closes it.
+func (r *Registry) Delete(namespacedName types.NamespacedName) {
+	r.mu.Lock()
+	e, loaded := r.entries[namespacedName]
+	delete(r.entries, namespacedName)
+	r.mu.Unlock()
+
+	if loaded {
+		e.provisioner.Close()
+	}
+}
+
+// Len returns the number of provisioners.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.entries)
+}
+
+// RegistryEntry describes a provisioner of a Registry.
+type RegistryEntry struct {
+	// Issuer NamespacedName of the Issuer, or name of the ClusterIssuer
+	Issuer types.NamespacedName
+	// Generation of the spec the provisioner was built from
+	Generation int64
+	// Built time the provisioner was stored
+	Built time.Time
+	// Servers health of the FreeIPA servers
+	Servers []api.ServerStatus
+}
+
+// Snapshot describes the provisioners of the Registry, sorted by issuer.
+func (r *Registry) Snapshot() []RegistryEntry {
+	r.mu.RLock()
+	snapshot := make([]RegistryEntry, 0, len(r.entries))
+	for namespacedName, e := range r.entries {
+		snapshot = append(snapshot, RegistryEntry{
+			Issuer:     namespacedName,
+			Generation: e.generation,
+			Built:      e.built,
+			Servers:    e.provisioner.ServerStatuses(),
+		})
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Issuer.String() < snapshot[j].Issuer.String()
+	})
+
+	return snapshot
+}
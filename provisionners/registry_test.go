@@ -0,0 +1,312 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newRegistryIPA returns a fakeIPA answering ping and session_logout, and a
+// function building provisioners logged in to it.
+func newRegistryIPA(t *testing.T) (*fakeIPA, func() *FreeIPAPKI) {
+	t.Helper()
+
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	ipa.handle("session_logout", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{}, nil
+	})
+	ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"summary": "pong"}, nil
+	})
+
+	return ipa, func() *FreeIPAPKI {
+		p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, &api.IssuerSpec{Host: ipa.host(), Insecure: true}, &Credentials{User: "admin", Password: "secret"})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		return p
+	}
+}
+
+func ping(c *freeipa.Client) error {
+	_, err := c.Ping(&freeipa.PingArgs{}, &freeipa.PingOptionalArgs{})
+	return err
+}
+
+func logouts(ipa *fakeIPA) int {
+	var n int
+	for _, method := range ipa.called() {
+		if method == "session_logout" {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestRegistry(t *testing.T) {
+	ipa, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+	name := types.NamespacedName{Name: "issuer", Namespace: "default"}
+
+	first := newProvisioner()
+	r.Store(name, 1, first)
+	if p, ok := r.Load(name); !ok || p != first {
+		t.Fatalf("Load() = %v, %v, want the stored provisioner", p, ok)
+	}
+
+	second := newProvisioner()
+	r.Store(name, 2, second)
+	if generation, ok := r.Generation(name); !ok || generation != 2 {
+		t.Errorf("Generation() = %d, %v, want 2", generation, ok)
+	}
+
+	// The replaced provisioner is closed.
+	var transportErr *TransportError
+	if err := classify(first.call(ping)); !errors.As(err, &transportErr) {
+		t.Errorf("call() of replaced provisioner error = %v, want TransportError", err)
+	}
+	if err := second.call(ping); err != nil {
+		t.Errorf("call() error = %v", err)
+	}
+
+	r.Delete(name)
+	if _, ok := r.Load(name); ok {
+		t.Error("Load() found a deleted provisioner")
+	}
+	if err := classify(second.call(ping)); !errors.As(err, &transportErr) {
+		t.Errorf("call() of deleted provisioner error = %v, want TransportError", err)
+	}
+
+	if got := logouts(ipa); got != 2 {
+		t.Errorf("got %d logouts, want 2", got)
+	}
+}
+
+func TestRegistry_LoadCurrent(t *testing.T) {
+	_, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+	name := types.NamespacedName{Name: "issuer", Namespace: "default"}
+	creds := &Credentials{User: "admin", Password: "secret"}
+
+	p := newProvisioner()
+	r.Store(name, 1, p)
+
+	if got, ok := r.LoadCurrent(name, 1, creds); !ok || got != p {
+		t.Errorf("LoadCurrent() = %v, %v, want the stored provisioner", got, ok)
+	}
+	if _, ok := r.LoadCurrent(name, 2, creds); ok {
+		t.Error("LoadCurrent() returned the provisioner of another generation")
+	}
+	if _, ok := r.LoadCurrent(name, 1, &Credentials{User: "admin", Password: "rotated"}); ok {
+		t.Error("LoadCurrent() returned the provisioner of other credentials")
+	}
+}
+
+func TestRegistry_New_refused(t *testing.T) {
+	first := newFakeIPA(t)
+	second := newFakeIPA(t)
+	for _, ipa := range []*fakeIPA{first, second} {
+		ipa.user = "admin"
+		ipa.password = "secret"
+		ipa.handle("session_logout", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+			return map[string]interface{}{}, nil
+		})
+	}
+
+	r := NewRegistry(DefaultClusterName)
+	name := types.NamespacedName{Name: "issuer", Namespace: "default"}
+	spec := &api.IssuerSpec{Hosts: []string{first.host(), second.host()}, Insecure: true}
+	wrong := &Credentials{User: "admin", Password: "wrong"}
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.New(name, spec, wrong); Reason(err) != ReasonAuthenticationFailed {
+			t.Fatalf("New() error = %v, want an authentication failure", err)
+		}
+	}
+	// The servers share the accounts, so only the first one is tried, once.
+	if got := first.refusalCount(); got != 1 {
+		t.Errorf("first server got %d refused logins, want 1", got)
+	}
+	if got := second.refusalCount(); got != 0 {
+		t.Errorf("second server got %d refused logins, want 0", got)
+	}
+
+	// Other credentials are tried.
+	p, err := r.New(name, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	p.Close()
+
+	// So are the refused ones after others logged in.
+	if _, err := r.New(name, spec, wrong); Reason(err) != ReasonAuthenticationFailed {
+		t.Fatalf("New() error = %v, want an authentication failure", err)
+	}
+	if got := first.refusalCount(); got != 2 {
+		t.Errorf("first server got %d refused logins, want 2", got)
+	}
+}
+
+func TestRegistry_LoadOrBuild(t *testing.T) {
+	_, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+	name := types.NamespacedName{Name: "issuer", Namespace: "default"}
+
+	if _, err := r.LoadOrBuild(context.Background(), name, func() (*FreeIPAPKI, int64, error) {
+		return nil, 0, errors.New("no issuer")
+	}); err == nil {
+		t.Fatal("LoadOrBuild() with failing build succeeded")
+	}
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d after failed build, want 0", r.Len())
+	}
+
+	built := newProvisioner()
+	p, err := r.LoadOrBuild(context.Background(), name, func() (*FreeIPAPKI, int64, error) {
+		return built, 3, nil
+	})
+	if err != nil || p != built {
+		t.Fatalf("LoadOrBuild() = %v, %v, want the built provisioner", p, err)
+	}
+	if generation, _ := r.Generation(name); generation != 3 {
+		t.Errorf("Generation() = %d, want 3", generation)
+	}
+
+	p, err = r.LoadOrBuild(context.Background(), name, func() (*FreeIPAPKI, int64, error) {
+		t.Error("LoadOrBuild() built a stored provisioner")
+		return nil, 0, nil
+	})
+	if err != nil || p != built {
+		t.Errorf("LoadOrBuild() = %v, %v, want the stored provisioner", p, err)
+	}
+}
+
+func TestRegistry_LoadOrBuild_concurrent(t *testing.T) {
+	_, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+	name := types.NamespacedName{Name: "issuer", Namespace: "default"}
+
+	built := newProvisioner()
+	release := make(chan struct{})
+	var builds int32
+	build := func() (*FreeIPAPKI, int64, error) {
+		atomic.AddInt32(&builds, 1)
+		<-release
+		return built, 1, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*FreeIPAPKI, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := r.LoadOrBuild(context.Background(), name, build)
+			if err != nil {
+				t.Errorf("LoadOrBuild() error = %v", err)
+			}
+			results[i] = p
+		}(i)
+	}
+
+	// Let the callers wait for the build before it completes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&builds); got != 1 {
+		t.Errorf("got %d builds, want 1", got)
+	}
+	for i, p := range results {
+		if p != built {
+			t.Errorf("LoadOrBuild() #%d = %v, want the built provisioner", i, p)
+		}
+	}
+}
+
+func TestRegistry_LoadOrBuild_canceled(t *testing.T) {
+	_, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+	name := types.NamespacedName{Name: "issuer", Namespace: "default"}
+
+	built := newProvisioner()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := r.LoadOrBuild(context.Background(), name, func() (*FreeIPAPKI, int64, error) {
+			close(started)
+			<-release
+			return built, 1, nil
+		}); err != nil {
+			t.Errorf("LoadOrBuild() error = %v", err)
+		}
+	}()
+	<-started
+
+	// A caller waiting for the build gives up when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if p, err := r.LoadOrBuild(ctx, name, func() (*FreeIPAPKI, int64, error) {
+		t.Error("LoadOrBuild() built a provisioner being built")
+		return nil, 0, nil
+	}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LoadOrBuild() = %v, %v, want %v", p, err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	<-done
+	if p, ok := r.Load(name); !ok || p != built {
+		t.Errorf("Load() = %v, %v, want the built provisioner", p, ok)
+	}
+}
+
+func TestRegistry_Snapshot(t *testing.T) {
+	_, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+
+	r.Store(types.NamespacedName{Name: "b", Namespace: "default"}, 2, newProvisioner())
+	r.Store(types.NamespacedName{Name: "a"}, 1, newProvisioner())
+
+	snapshot := r.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Snapshot() = %+v, want 2 entries", snapshot)
+	}
+	if snapshot[0].Issuer.Name != "a" || snapshot[0].Generation != 1 || snapshot[1].Issuer.Name != "b" || snapshot[1].Generation != 2 {
+		t.Errorf("Snapshot() = %+v, want a then b", snapshot)
+	}
+	if len(snapshot[0].Servers) != 1 || !snapshot[0].Servers[0].Healthy {
+		t.Errorf("Snapshot() servers = %+v, want a healthy server", snapshot[0].Servers)
+	}
+}
+
+func TestRegistry_Start(t *testing.T) {
+	ipa, newProvisioner := newRegistryIPA(t)
+	r := NewRegistry(DefaultClusterName)
+	r.Store(types.NamespacedName{Name: "a"}, 1, newProvisioner())
+	r.Store(types.NamespacedName{Name: "b"}, 1, newProvisioner())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d after stop, want 0", r.Len())
+	}
+	if got := logouts(ipa); got != 2 {
+		t.Errorf("got %d logouts, want 2", got)
+	}
+}
@@ -0,0 +1,57 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+)
+
+// RevocationPolicy returns when the certificates signed by the provisioner
+// are revoked.
+func (s *FreeIPAPKI) RevocationPolicy() api.RevocationPolicy {
+	if s.spec.Revocation == nil || s.spec.Revocation.Policy == "" {
+		return api.RevocationPolicyNever
+	}
+
+	return s.spec.Revocation.Policy
+}
+
+// Revoke revokes the first certificate of the PEM encoded chain with the
+// revocation reason of the spec. Certificates unknown to FreeIPA are ignored.
+func (s *FreeIPAPKI) Revoke(ctx context.Context, certPem []byte) error {
+	cert, err := pki.DecodeX509CertificateBytes(certPem)
+	if err != nil {
+		return fmt.Errorf("failed to decode certificate to revoke: %v", err)
+	}
+
+	if !cert.SerialNumber.IsInt64() {
+		return fmt.Errorf("serial number %s of certificate to revoke is too large", cert.SerialNumber)
+	}
+	serial := int(cert.SerialNumber.Int64())
+
+	reason := 0
+	if s.spec.Revocation != nil {
+		reason = s.spec.Revocation.Reason
+	}
+
+	return s.call(func(client *freeipa.Client) error {
+		_, err := client.CertRevoke(&freeipa.CertRevokeArgs{SerialNumber: serial}, &freeipa.CertRevokeOptionalArgs{
+			RevocationReason: &reason,
+			Cacn:             &s.spec.Ca,
+		})
+
+		var ipaErr *freeipa.Error
+		if errors.As(err, &ipaErr) && ipaErr.Code == freeipa.NotFoundCode {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("fail revoking certificate %d: %w", serial, err)
+		}
+
+		return nil
+	})
+}
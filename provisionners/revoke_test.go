@@ -0,0 +1,104 @@
+package provisioners
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newCertificate(t *testing.T, serial int64) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "www.example.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestRevoke(t *testing.T) {
+	tests := []struct {
+		name       string
+		serial     int64
+		revocation *api.RevocationSpec
+		wantReason float64
+		wantErr    bool
+	}{
+		{
+			name:       "default reason",
+			serial:     42,
+			wantReason: 0,
+		},
+		{
+			name:       "superseded",
+			serial:     42,
+			revocation: &api.RevocationSpec{Policy: api.RevocationPolicyOnSupersede, Reason: 4},
+			wantReason: 4,
+		},
+		{
+			name:   "unknown certificate",
+			serial: 7,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+
+			var gotReason float64
+			ipa.handle("cert_revoke", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+				if options["serial_number"] != float64(42) {
+					return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "Certificate serial number 0x7 not found"}
+				}
+				if options["cacn"] != "ipa" {
+					return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "CA not found"}
+				}
+				gotReason, _ = options["revocation_reason"].(float64)
+				return map[string]interface{}{"value": "42", "result": map[string]interface{}{"revoked": true}}, nil
+			})
+
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, Ca: "ipa", Revocation: tt.revocation}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			if err := p.Revoke(context.Background(), newCertificate(t, tt.serial)); (err != nil) != tt.wantErr {
+				t.Fatalf("Revoke() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotReason != tt.wantReason {
+				t.Errorf("revocation_reason = %v, want %v", gotReason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestRevoke_invalidCertificate(t *testing.T) {
+	p := &FreeIPAPKI{spec: &api.IssuerSpec{}}
+	if err := p.Revoke(context.Background(), []byte("not a certificate")); err == nil {
+		t.Error("Revoke() error = nil, want error")
+	}
+}
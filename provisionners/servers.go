@@ -0,0 +1,507 @@
+package provisioners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/clock"
+)
+
+// Clock is defined as a package var so it can be stubbed out during tests.
+var Clock clock.Clock = clock.RealClock{}
+
+// lookupSRV is defined as a package var so it can be stubbed out during tests.
+var lookupSRV = net.LookupSRV
+
+const (
+	// dialTimeout bounds the connection to a FreeIPA server.
+	dialTimeout = 10 * time.Second
+
+	// tlsHandshakeTimeout bounds the TLS handshake with a FreeIPA server.
+	tlsHandshakeTimeout = 10 * time.Second
+
+	// requestTimeout bounds a FreeIPA call, from the request to the end of
+	// the answer, signing included.
+	requestTimeout = time.Minute
+)
+
+// newTransport returns the transport of the connections to the FreeIPA
+// servers.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		DialContext:           (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: requestTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// withTimeout returns a transport giving up on the requests not answered
+// within timeout. The FreeIPA client builds its HTTP client from a transport,
+// so the timeout of the calls can only be set there.
+func withTimeout(next http.RoundTripper, timeout time.Duration) *http.Transport {
+	t := &http.Transport{
+		// Every request goes through the registered protocol.
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+	t.RegisterProtocol("https", &timeoutRoundTripper{next: next, timeout: timeout})
+
+	return t
+}
+
+// timeoutRoundTripper is a RoundTripper cancelling the requests after a
+// timeout.
+type timeoutRoundTripper struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// cancelBody is the body of a response, which releases the context of its
+// request once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// connectFunc logs in to a FreeIPA server.
+type connectFunc func(host string) (*freeipa.Client, error)
+
+// server is a FreeIPA server with its session and health. mu guards the
+// state of the server and is never held during network calls, so that the
+// health of the server is known while it logs in; login serializes the
+// logins.
+type server struct {
+	host string
+
+	login sync.Mutex
+
+	mu      sync.Mutex
+	client  *freeipa.Client
+	closed  bool
+	err     error
+	checked *metav1.Time
+}
+
+// errClosed is the error of the calls of a closed provisioner.
+var errClosed = errors.New("provisioner is closed")
+
+// session returns the client of the server, logging in first if needed.
+func (s *server) session(connect connectFunc) (*freeipa.Client, error) {
+	s.mu.Lock()
+	client, closed := s.client, s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return nil, errClosed
+	}
+	if client != nil {
+		return client, nil
+	}
+
+	return s.relogin(connect, nil)
+}
+
+// relogin replaces the client of the server with a new session, unless
+// another caller already replaced the stale client.
+func (s *server) relogin(connect connectFunc, stale *freeipa.Client) (*freeipa.Client, error) {
+	s.login.Lock()
+	defer s.login.Unlock()
+
+	s.mu.Lock()
+	current, closed := s.client, s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return nil, errClosed
+	}
+	if current != nil && current != stale {
+		return current, nil
+	}
+
+	client, err := connect(s.host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server may have been closed during the login.
+	s.mu.Lock()
+	closed = s.closed
+	if !closed {
+		s.client = client
+	}
+	s.mu.Unlock()
+
+	if closed {
+		_, _ = client.SessionLogout(&freeipa.SessionLogoutArgs{}, &freeipa.SessionLogoutOptionalArgs{})
+		return nil, errClosed
+	}
+
+	return client, nil
+}
+
+// close logs out of the server, which accepts no more calls.
+func (s *server) close() {
+	s.mu.Lock()
+	client := s.client
+	s.client = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	if client != nil {
+		_, _ = client.SessionLogout(&freeipa.SessionLogoutArgs{}, &freeipa.SessionLogoutOptionalArgs{})
+	}
+}
+
+// report records the health of the server after a call. The check time
+// only changes when the server becomes healthy or unhealthy, so that the
+// status of the issuer is not rewritten after every call.
+func (s *server) report(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.checked == nil || (s.err == nil) != (err == nil) {
+		now := metav1.NewTime(Clock.Now())
+		s.checked = &now
+	}
+	s.err = err
+}
+
+func (s *server) healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err == nil
+}
+
+func (s *server) status() api.ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := api.ServerStatus{
+		Host:          s.host,
+		Healthy:       s.err == nil,
+		LastCheckTime: s.checked,
+	}
+	if s.err != nil {
+		st.Message = s.err.Error()
+	}
+
+	return st
+}
+
+// call runs fn against the first healthy server. On connection and server
+// errors, the server is marked unhealthy and fn is run against the next one.
+// Unhealthy servers are tried last. When the session of a server has expired,
+// fn is retried once with a new session.
+func (s *FreeIPAPKI) call(fn func(c *freeipa.Client) error) error {
+	if err := s.refusal(); err != nil {
+		return err
+	}
+
+	current := s.serverList()
+	servers := make([]*server, 0, len(current))
+	for _, srv := range current {
+		if srv.healthy() {
+			servers = append(servers, srv)
+		}
+	}
+	for _, srv := range current {
+		if !srv.healthy() {
+			servers = append(servers, srv)
+		}
+	}
+
+	var err error
+	for _, srv := range servers {
+		var client *freeipa.Client
+		client, err = srv.session(s.connect)
+		if err == nil {
+			err = fn(client)
+			if err != nil && isAuthError(err) {
+				client, err = srv.relogin(s.connect, client)
+				if err == nil {
+					err = fn(client)
+				}
+			}
+		}
+
+		if err == nil || !isServerError(err) {
+			srv.report(nil)
+			if err != nil && isAuthError(err) {
+				s.refuse(err)
+			}
+			return err
+		}
+
+		srv.report(err)
+	}
+
+	return err
+}
+
+// refuse records that FreeIPA refused the credentials, so that no call logs
+// in with them again.
+func (s *FreeIPAPKI) refuse(err error) {
+	s.refusedMu.Lock()
+	defer s.refusedMu.Unlock()
+
+	if s.refused == nil {
+		s.refused = err
+	}
+}
+
+// refusal returns the error of FreeIPA refusing the credentials, or nil when
+// it did not.
+func (s *FreeIPAPKI) refusal() error {
+	s.refusedMu.Lock()
+	defer s.refusedMu.Unlock()
+
+	if s.refused == nil {
+		return nil
+	}
+
+	return fmt.Errorf("FreeIPA refused the credentials, not logging in again until they change: %w", s.refused)
+}
+
+// ServerStatuses returns the health of every FreeIPA server.
+func (s *FreeIPAPKI) ServerStatuses() []api.ServerStatus {
+	servers := s.serverList()
+	statuses := make([]api.ServerStatus, 0, len(servers))
+	for _, srv := range servers {
+		statuses = append(statuses, srv.status())
+	}
+
+	return statuses
+}
+
+// serverList returns the current FreeIPA servers.
+func (s *FreeIPAPKI) serverList() []*server {
+	s.serversMu.RLock()
+	defer s.serversMu.RUnlock()
+
+	return s.servers
+}
+
+// hosts returns the hosts of the current FreeIPA servers.
+func (s *FreeIPAPKI) hosts() []string {
+	servers := s.serverList()
+	hosts := make([]string, 0, len(servers))
+	for _, srv := range servers {
+		hosts = append(hosts, srv.host)
+	}
+
+	return hosts
+}
+
+// Discover looks the servers of the Domain of the spec up again, so that
+// the provisioner follows the SRV records: new servers are added, logging in
+// on their first call, and the servers gone are logged out. The servers are
+// left as they are when the lookup fails.
+func (s *FreeIPAPKI) Discover() error {
+	if s.spec.Domain == "" {
+		return nil
+	}
+
+	discovered, err := discoverServers(s.spec.Domain, s.spec.Location)
+	if err != nil {
+		return err
+	}
+	hosts := joinHosts(s.spec, discovered)
+
+	s.serversMu.Lock()
+	if s.closed {
+		s.serversMu.Unlock()
+		return nil
+	}
+	gone := map[string]*server{}
+	for _, srv := range s.servers {
+		gone[srv.host] = srv
+	}
+	servers := make([]*server, 0, len(hosts))
+	for _, host := range hosts {
+		srv, ok := gone[host]
+		if !ok {
+			srv = &server{host: host}
+		}
+		delete(gone, host)
+		servers = append(servers, srv)
+	}
+	s.servers = servers
+	s.serversMu.Unlock()
+
+	for _, srv := range gone {
+		srv.close()
+	}
+
+	return nil
+}
+
+var statusCodeRegexp = regexp.MustCompile(`unexpected http status code: (\d+)`)
+
+// isServerError reports whether err is a connection error or a 5xx
+// response, meaning that another server may succeed.
+func isServerError(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// The FreeIPA client only reports HTTP status codes in error messages.
+	if m := statusCodeRegexp.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code >= 500
+	}
+
+	return false
+}
+
+// isAuthError reports whether err means that the session is no longer
+// valid: a 401 response the FreeIPA client could not recover from by itself,
+// or an authentication, Kerberos or session error such as an expired ticket.
+func isAuthError(err error) bool {
+	var ipaErr *freeipa.Error
+	if errors.As(err, &ipaErr) {
+		return ipaErr.Code >= freeipa.AuthenticationErrorCode && ipaErr.Code < freeipa.AuthorizationErrorCode
+	}
+
+	if strings.Contains(err.Error(), "renewed login failed") {
+		return true
+	}
+
+	if m := statusCodeRegexp.FindStringSubmatch(err.Error()); m != nil {
+		return m[1] == "401"
+	}
+
+	return false
+}
+
+// serverHosts returns the FreeIPA servers configured in the spec: Host,
+// then Hosts, then the servers discovered from the Domain.
+func serverHosts(spec *api.IssuerSpec) ([]string, error) {
+	var discovered []string
+	if spec.Domain != "" {
+		var err error
+		discovered, err = discoverServers(spec.Domain, spec.Location)
+		if err != nil && len(joinHosts(spec, nil)) == 0 {
+			return nil, err
+		}
+	}
+
+	hosts := joinHosts(spec, discovered)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no FreeIPA server configured, set host, hosts or domain")
+	}
+
+	return hosts, nil
+}
+
+// joinHosts returns Host, then Hosts, then the discovered servers, without
+// duplicates.
+func joinHosts(spec *api.IssuerSpec, discovered []string) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	add := func(host string) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	add(spec.Host)
+	for _, host := range spec.Hosts {
+		add(host)
+	}
+	for _, host := range discovered {
+		add(host)
+	}
+
+	return hosts
+}
+
+// discoverServers returns the FreeIPA servers of the domain from the
+// _ldap._tcp and _kerberos._tcp SRV records. Servers of the IPA location
+// come first.
+func discoverServers(domain, location string) ([]string, error) {
+	names := []string{domain}
+	if location != "" {
+		names = []string{fmt.Sprintf("%s._locations.%s", location, domain), domain}
+	}
+
+	var hosts []string
+	var lastErr error
+	seen := map[string]bool{}
+	for _, name := range names {
+		var records []*net.SRV
+		for _, service := range []string{"ldap", "kerberos"} {
+			_, addrs, err := lookupSRV(service, "tcp", name)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			records = append(records, addrs...)
+		}
+
+		// Keep the priority order of the records across both services.
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].Priority < records[j].Priority
+		})
+
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			if host != "" && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	if len(hosts) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no SRV record found")
+		}
+		return nil, fmt.Errorf("failed to discover FreeIPA servers of %s: %v", domain, lastErr)
+	}
+
+	return hosts, nil
+}
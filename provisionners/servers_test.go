@@ -0,0 +1,443 @@
+package provisioners
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestFailover(t *testing.T) {
+	first := newFakeIPA(t)
+	second := newFakeIPA(t)
+	for _, ipa := range []*fakeIPA{first, second} {
+		ipa.user = "admin"
+		ipa.password = "secret"
+		ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+			return map[string]interface{}{"summary": "pong"}, nil
+		})
+	}
+
+	spec := &api.IssuerSpec{Hosts: []string{first.host(), second.host()}, Insecure: true}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	first.Close()
+
+	ping := func(c *freeipa.Client) error {
+		_, err := c.Ping(&freeipa.PingArgs{}, &freeipa.PingOptionalArgs{})
+		return err
+	}
+
+	if err := p.call(ping); err != nil {
+		t.Fatalf("call() error = %v", err)
+	}
+	if got := len(second.called()); got != 1 {
+		t.Errorf("second server got %d calls, want 1", got)
+	}
+
+	statuses := p.ServerStatuses()
+	if statuses[0].Healthy || !statuses[1].Healthy {
+		t.Errorf("ServerStatuses() = %+v, want first unhealthy and second healthy", statuses)
+	}
+
+	// The unhealthy server is only tried after the healthy ones.
+	if err := p.call(ping); err != nil {
+		t.Fatalf("call() error = %v", err)
+	}
+	if got := len(second.called()); got != 2 {
+		t.Errorf("second server got %d calls, want 2", got)
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"summary": "pong"}, nil
+	})
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ping := func(c *freeipa.Client) error {
+		_, err := c.Ping(&freeipa.PingArgs{}, &freeipa.PingOptionalArgs{})
+		return err
+	}
+
+	ipa.expireSessions()
+
+	// Concurrent calls share a single new session.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.call(ping)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("call() error = %v", err)
+		}
+	}
+	if got := ipa.loginCount(); got != 2 {
+		t.Errorf("got %d logins, want 2", got)
+	}
+
+	// A call failing again after the new login is not retried twice.
+	ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return nil, &freeipa.Error{Code: freeipa.SessionErrorCode, Name: "SessionError", Message: "session error"}
+	})
+	if err := p.call(ping); !isAuthError(err) {
+		t.Errorf("call() error = %v, want an auth error", err)
+	}
+	if got := ipa.loginCount(); got != 3 {
+		t.Errorf("got %d logins, want 3", got)
+	}
+}
+
+func TestCall_refused(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	ipa.handle("ping", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"summary": "pong"}, nil
+	})
+
+	spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true}
+	p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ping := func(c *freeipa.Client) error {
+		_, err := c.Ping(&freeipa.PingArgs{}, &freeipa.PingOptionalArgs{})
+		return err
+	}
+
+	ipa.mu.Lock()
+	ipa.password = "rotated"
+	ipa.mu.Unlock()
+	ipa.expireSessions()
+
+	var authErr *AuthError
+	if err := classify(p.call(ping)); !errors.As(err, &authErr) {
+		t.Fatalf("call() error = %v, want AuthError", err)
+	}
+
+	// Once refused, the credentials are not tried again.
+	calls := len(ipa.called())
+	for i := 0; i < 3; i++ {
+		if err := classify(p.call(ping)); !errors.As(err, &authErr) {
+			t.Errorf("call() error = %v, want AuthError", err)
+		}
+	}
+	if got := ipa.refusalCount(); got != 1 {
+		t.Errorf("got %d refused logins, want 1", got)
+	}
+	if got := len(ipa.called()); got != calls {
+		t.Errorf("got %d calls after the refusal, want none", got-calls)
+	}
+}
+
+func Test_discoverServers(t *testing.T) {
+	records := map[string][]*net.SRV{
+		"_ldap._tcp.example.test": {
+			{Target: "ipa1.example.test.", Port: 389, Priority: 0},
+			{Target: "ipa2.example.test.", Port: 389, Priority: 0},
+		},
+		"_kerberos._tcp.example.test": {
+			{Target: "ipa1.example.test.", Port: 88, Priority: 0},
+			{Target: "ipa3.example.test.", Port: 88, Priority: 10},
+		},
+		"_ldap._tcp.paris._locations.example.test": {
+			{Target: "ipa2.example.test.", Port: 389, Priority: 0},
+		},
+	}
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		cname := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+		addrs, ok := records[cname]
+		if !ok {
+			return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+		}
+		return cname, addrs, nil
+	}
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	tests := []struct {
+		name     string
+		domain   string
+		location string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:   "domain",
+			domain: "example.test",
+			want:   []string{"ipa1.example.test", "ipa2.example.test", "ipa3.example.test"},
+		},
+		{
+			name:     "location first",
+			domain:   "example.test",
+			location: "paris",
+			want:     []string{"ipa2.example.test", "ipa1.example.test", "ipa3.example.test"},
+		},
+		{
+			name:    "unknown domain",
+			domain:  "unknown.test",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discoverServers(tt.domain, tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discoverServers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discoverServers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreeIPAPKI_Discover(t *testing.T) {
+	records := map[string][]*net.SRV{}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		cname := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+		addrs, ok := records[cname]
+		if !ok {
+			return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+		}
+		return cname, addrs, nil
+	}
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	kept := &server{host: "ipa2.example.test"}
+	gone := &server{host: "ipa1.example.test"}
+	p := &FreeIPAPKI{
+		spec:      &api.IssuerSpec{Host: "ipa.example.test", Domain: "example.test"},
+		servers:   []*server{{host: "ipa.example.test"}, gone, kept},
+		transport: &http.Transport{},
+	}
+
+	records["_ldap._tcp.example.test"] = []*net.SRV{{Target: "ipa2.example.test."}, {Target: "ipa3.example.test."}}
+	if err := p.Discover(); err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	want := []string{"ipa.example.test", "ipa2.example.test", "ipa3.example.test"}
+	if got := p.hosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts() = %v, want %v", got, want)
+	}
+	if p.serverList()[1] != kept {
+		t.Error("Discover() replaced a server still discovered")
+	}
+	if !gone.closed {
+		t.Error("Discover() did not close the server gone")
+	}
+
+	// The servers are kept when the lookup fails.
+	delete(records, "_ldap._tcp.example.test")
+	if err := p.Discover(); err == nil {
+		t.Error("Discover() error = nil, want an error")
+	}
+	if got := p.hosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts() = %v, want %v", got, want)
+	}
+
+	// No server is added to a closed provisioner.
+	p.Close()
+	records["_ldap._tcp.example.test"] = []*net.SRV{{Target: "ipa4.example.test."}}
+	if err := p.Discover(); err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	if got := p.hosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts() = %v, want %v", got, want)
+	}
+}
+
+func Test_isServerError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "connection refused",
+			err:  &url.Error{Op: "Post", URL: "https://ipa.example.test/ipa/session/json", Err: errors.New("connection refused")},
+			want: true,
+		},
+		{
+			name: "wrapped service unavailable",
+			err:  fmt.Errorf("fail adding host: %w", errors.New("unexpected http status code: 503")),
+			want: true,
+		},
+		{
+			name: "unauthorized",
+			err:  errors.New("unexpected http status code: 401"),
+		},
+		{
+			name: "FreeIPA error",
+			err:  &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "not found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isServerError(tt.err); got != tt.want {
+				t.Errorf("isServerError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "ticket expired",
+			err:  fmt.Errorf("fail getting host: %w", &freeipa.Error{Code: freeipa.TicketExpiredCode, Name: "TicketExpired", Message: "Ticket expired"}),
+			want: true,
+		},
+		{
+			name: "unauthorized",
+			err:  errors.New("unexpected http status code: 401"),
+			want: true,
+		},
+		{
+			name: "renewed login failed",
+			err:  errors.New("renewed login failed: connection reset by peer"),
+			want: true,
+		},
+		{
+			name: "ACL error",
+			err:  &freeipa.Error{Code: freeipa.ACIErrorCode, Name: "ACIError", Message: "Insufficient access"},
+		},
+		{
+			name: "service unavailable",
+			err:  errors.New("unexpected http status code: 503"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuthError(tt.err); got != tt.want {
+				t.Errorf("isAuthError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_report(t *testing.T) {
+	defer func(c clock.Clock) { Clock = c }(Clock)
+	fakeClock := clocktesting.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	Clock = fakeClock
+
+	srv := &server{host: "ipa.example.test"}
+	srv.report(nil)
+	first := srv.status().LastCheckTime
+
+	// The status does not change while the server stays healthy.
+	fakeClock.Step(time.Minute)
+	srv.report(nil)
+	if got := srv.status().LastCheckTime; !got.Equal(first) {
+		t.Errorf("LastCheckTime = %v after a healthy call, want %v", got, first)
+	}
+
+	fakeClock.Step(time.Minute)
+	srv.report(errors.New("connection refused"))
+	if got := srv.status().LastCheckTime; !got.Time.Equal(fakeClock.Now()) {
+		t.Errorf("LastCheckTime = %v after the server failed, want %v", got, fakeClock.Now())
+	}
+}
+
+func TestServer_session(t *testing.T) {
+	srv := &server{host: "ipa.example.test"}
+	srv.report(nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	connect := func(host string) (*freeipa.Client, error) {
+		close(started)
+		<-release
+		return nil, errors.New("connection refused")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := srv.session(connect)
+		done <- err
+	}()
+	<-started
+
+	// The health of the server is known during the login.
+	status := make(chan api.ServerStatus)
+	go func() { status <- srv.status() }()
+	select {
+	case st := <-status:
+		if !st.Healthy {
+			t.Errorf("status() = %+v during the login, want healthy", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("status() blocked by the login")
+	}
+
+	close(release)
+	if err := <-done; err == nil {
+		t.Error("session() error = nil, want the login error")
+	}
+}
+
+func Test_withTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	transport := newTransport(&tls.Config{InsecureSkipVerify: true})
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: withTimeout(transport, 50*time.Millisecond)}
+
+	start := time.Now()
+	_, err := client.Get(slow.URL)
+	if err == nil {
+		t.Fatal("Get() error = nil, want a timeout")
+	}
+	if !isServerError(err) {
+		t.Errorf("Get() error = %v, want a server error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Get() returned after %v, want the timeout", elapsed)
+	}
+}
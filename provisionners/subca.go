@@ -0,0 +1,166 @@
+package provisioners
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/jetstack/cert-manager/pkg/util/pki"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// SubCAError means that a CA certificate request can't be signed with a
+// lightweight sub-CA.
+type SubCAError struct {
+	msg string
+}
+
+func (e *SubCAError) Error() string {
+	return e.msg
+}
+
+// caNameRegexp matches the names FreeIPA accepts for a CA.
+var caNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// subCAEnabled reports whether the provisioner signs CA certificate requests.
+func (s *FreeIPAPKI) subCAEnabled() bool {
+	return s.spec.SubCA != nil && s.spec.SubCA.Enabled
+}
+
+// mainCA is the name of the main CA of FreeIPA, which issues the
+// lightweight sub-CAs.
+const mainCA = "ipa"
+
+// signCA returns the certificate and the chain of the lightweight sub-CA
+// named after the common name of the request. FreeIPA generates the key of a
+// sub-CA and keeps it, so the request is only signed when the sub-CA exists
+// with the subject and the key of the request: the issuer does not create
+// sub-CAs, as their certificate could never match the key of the request.
+func (s *FreeIPAPKI) signCA(ctx context.Context, cr *certmanager.CertificateRequest, csr *x509.CertificateRequest) (CertPem, CaPem, error) {
+	if !s.subCAEnabled() {
+		return nil, nil, &SubCAError{"the issuer does not sign CA certificates, enable subCA to use lightweight sub-CAs"}
+	}
+	if !strings.EqualFold(s.spec.Ca, mainCA) {
+		return nil, nil, &SubCAError{fmt.Sprintf("FreeIPA issues lightweight sub-CAs with its main CA %s, not with CA %s", mainCA, s.spec.Ca)}
+	}
+
+	name := csr.Subject.CommonName
+	if !caNameRegexp.MatchString(name) {
+		return nil, nil, &SubCAError{fmt.Sprintf("common name %q is not a valid sub-CA name", name)}
+	}
+	if !subCANameAllowed(s.spec.SubCA.AllowedNames, name) {
+		return nil, nil, &SubCAError{fmt.Sprintf("sub-CA name %q is not allowed by the issuer", name)}
+	}
+	if err := s.checkNamePolicy(csr); err != nil {
+		return nil, nil, err
+	}
+
+	subject := csr.Subject.String()
+
+	var certPem string
+	var caPem string
+
+	err := s.call(func(client *freeipa.Client) error {
+		log.FromContext(ctx).WithName("signCA").V(1).Info("looking up lightweight sub-CA", "ca", name, "request", cr.Name)
+
+		parent, err := client.CaShow(&freeipa.CaShowArgs{Cn: s.spec.Ca}, &freeipa.CaShowOptionalArgs{Chain: freeipa.Bool(true)})
+		if err != nil {
+			return fmt.Errorf("fail getting CA %s: %w", s.spec.Ca, err)
+		}
+
+		ca, err := client.CaShow(&freeipa.CaShowArgs{Cn: name}, &freeipa.CaShowOptionalArgs{Chain: freeipa.Bool(true)})
+		var ipaErr *freeipa.Error
+		if errors.As(err, &ipaErr) && ipaErr.Code == freeipa.NotFoundCode {
+			return &SubCAError{fmt.Sprintf("sub-CA %s does not exist, and one created by FreeIPA could not have the key of the request", name)}
+		}
+		if err != nil {
+			return fmt.Errorf("fail getting sub-CA %s: %w", name, err)
+		}
+
+		if !sameDN(ca.Result.Ipacasubjectdn, subject) {
+			return &SubCAError{fmt.Sprintf("sub-CA %s exists with subject %q instead of %q", name, ca.Result.Ipacasubjectdn, subject)}
+		}
+		if !sameDN(ca.Result.Ipacaissuerdn, parent.Result.Ipacasubjectdn) {
+			return &SubCAError{fmt.Sprintf("sub-CA %s is issued by %q, not by CA %s", name, ca.Result.Ipacaissuerdn, s.spec.Ca)}
+		}
+		if err := sameKey(ca.Result.Certificate, csr); err != nil {
+			return &SubCAError{fmt.Sprintf("sub-CA %s: %v", name, err)}
+		}
+
+		chain := caChain(ca)
+		if len(chain) < 2 {
+			chain = append(chain, caChain(parent)...)
+		}
+
+		certPem, caPem, err = splitChain(ca.Result.Certificate, chain)
+		if err != nil {
+			return fmt.Errorf("sub-CA %s: %v", name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []byte(strings.TrimSpace(certPem)), []byte(strings.TrimSpace(caPem)), nil
+}
+
+// sameKey checks that the base64 encoded certificate has the public key of
+// the CSR.
+func sameKey(certificate string, csr *x509.CertificateRequest) error {
+	cert, err := pki.DecodeX509CertificateBytes([]byte(formatCertificate(certificate)))
+	if err != nil {
+		return fmt.Errorf("failed to decode certificate: %v", err)
+	}
+
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	csrKey, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certKey, csrKey) {
+		return errors.New("the key of the request is not the key FreeIPA generated for the sub-CA")
+	}
+
+	return nil
+}
+
+// subCANameAllowed reports whether the name matches one of the patterns.
+func subCANameAllowed(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameDN reports whether two DNs are equal, ignoring the case and the spaces
+// around the separators.
+func sameDN(a, b string) bool {
+	normalize := func(dn string) string {
+		parts := strings.Split(dn, ",")
+		for i, part := range parts {
+			kv := strings.SplitN(part, "=", 2)
+			for j := range kv {
+				kv[j] = strings.TrimSpace(kv[j])
+			}
+			parts[i] = strings.Join(kv, "=")
+		}
+		return strings.ToLower(strings.Join(parts, ","))
+	}
+
+	return normalize(a) == normalize(b)
+}
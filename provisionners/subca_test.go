@@ -0,0 +1,198 @@
+package provisioners
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSign_subCA(t *testing.T) {
+	tests := []struct {
+		name         string
+		commonName   string
+		ca           string
+		subCA        *api.SubCASpec
+		policy       *api.Policy
+		otherKey     bool
+		wantErr      bool
+		wantSubCAErr bool
+		wantNoCall   bool
+	}{
+		{
+			name:       "existing sub-CA",
+			commonName: "existing-ca",
+			subCA:      &api.SubCASpec{Enabled: true, AllowedNames: []string{"*-ca"}},
+		},
+		{
+			name:         "missing sub-CA",
+			commonName:   "team-ca",
+			subCA:        &api.SubCASpec{Enabled: true, AllowedNames: []string{"team-*"}},
+			wantErr:      true,
+			wantSubCAErr: true,
+		},
+		{
+			name:         "existing sub-CA with another key",
+			commonName:   "existing-ca",
+			subCA:        &api.SubCASpec{Enabled: true, AllowedNames: []string{"*-ca"}},
+			otherKey:     true,
+			wantErr:      true,
+			wantSubCAErr: true,
+		},
+		{
+			name:         "existing sub-CA with another subject",
+			commonName:   "other-ca",
+			subCA:        &api.SubCASpec{Enabled: true, AllowedNames: []string{"*-ca"}},
+			wantErr:      true,
+			wantSubCAErr: true,
+		},
+		{
+			name:       "name denied by the policy",
+			commonName: "existing-ca",
+			subCA:      &api.SubCASpec{Enabled: true, AllowedNames: []string{"*-ca"}},
+			policy:     &api.Policy{AllowedDNSNames: []string{"*.example.test"}},
+			wantErr:    true,
+			wantNoCall: true,
+		},
+		{
+			name:         "not the main CA",
+			commonName:   "existing-ca",
+			ca:           "existing-ca",
+			subCA:        &api.SubCASpec{Enabled: true, AllowedNames: []string{"*-ca"}},
+			wantErr:      true,
+			wantSubCAErr: true,
+			wantNoCall:   true,
+		},
+		{
+			name:         "name not allowed",
+			commonName:   "admin-ca",
+			subCA:        &api.SubCASpec{Enabled: true, AllowedNames: []string{"team-*"}},
+			wantErr:      true,
+			wantSubCAErr: true,
+			wantNoCall:   true,
+		},
+		{
+			name:         "invalid name",
+			commonName:   "team ca",
+			subCA:        &api.SubCASpec{Enabled: true, AllowedNames: []string{"*"}},
+			wantErr:      true,
+			wantSubCAErr: true,
+			wantNoCall:   true,
+		},
+		{
+			name:         "disabled",
+			commonName:   "team-ca",
+			wantErr:      true,
+			wantSubCAErr: true,
+			wantNoCall:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipa := newFakeIPA(t)
+			ipa.user = "admin"
+			ipa.password = "secret"
+
+			const parentDN = "CN=Certificate Authority,O=EXAMPLE.TEST"
+			cas := map[string]map[string]interface{}{
+				"ipa":         {"cn": []interface{}{"ipa"}, "ipacasubjectdn": []interface{}{parentDN}, "ipacaissuerdn": []interface{}{parentDN}, "certificate": ipa.chain.root},
+				"existing-ca": {"cn": []interface{}{"existing-ca"}, "ipacasubjectdn": []interface{}{"CN=existing-ca"}, "ipacaissuerdn": []interface{}{parentDN}, "certificate": ipa.chain.intermediate},
+				"other-ca":    {"cn": []interface{}{"other-ca"}, "ipacasubjectdn": []interface{}{"CN=other-ca,O=Other"}, "ipacaissuerdn": []interface{}{parentDN}, "certificate": ipa.chain.intermediate},
+			}
+			ipa.handle("ca_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+				cn, _ := options["cn"].(string)
+				ca, ok := cas[cn]
+				if !ok {
+					return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "CA not found"}
+				}
+				result := map[string]interface{}{"ipacaid": []interface{}{"1"}}
+				for k, v := range ca {
+					result[k] = v
+				}
+				if options["chain"] == true {
+					result["certificate_chain"] = []interface{}{ca["certificate"], ipa.chain.root}
+					if cn == "ipa" {
+						result["certificate_chain"] = []interface{}{ipa.chain.root}
+					}
+				}
+				return map[string]interface{}{"value": cn, "result": result}, nil
+			})
+			ipa.handle("ca_add", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+				t.Error("Sign() added a sub-CA")
+				return nil, &freeipa.Error{Code: freeipa.ACIErrorCode, Name: "ACIError", Message: "Insufficient access"}
+			})
+
+			ca := tt.ca
+			if ca == "" {
+				ca = "ipa"
+			}
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, Ca: ca, SubCA: tt.subCA, Policy: tt.policy}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			login := len(ipa.called())
+
+			request := newKeyCSR(t, ipa.chain.intermediateKey, tt.commonName)
+			if tt.otherKey {
+				request = newCSR(t, tt.commonName)
+			}
+			cr := &certmanager.CertificateRequest{Spec: certmanager.CertificateRequestSpec{Request: request, IsCA: true}}
+			cert, chain, _, err := p.Sign(context.Background(), cr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var subCAErr *SubCAError
+			if errors.As(err, &subCAErr) != tt.wantSubCAErr {
+				t.Errorf("Sign() error = %v, want SubCAError %v", err, tt.wantSubCAErr)
+			}
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) != (tt.policy != nil) {
+				t.Errorf("Sign() error = %v, want PolicyError %v", err, tt.policy != nil)
+			}
+			if calls := ipa.called()[login:]; tt.wantNoCall && len(calls) > 0 {
+				t.Errorf("Sign() called FreeIPA %v for a refused request", calls)
+			}
+			if err != nil {
+				return
+			}
+
+			if want := ipa.chain.pem(t, ipa.chain.intermediate); string(cert) != want {
+				t.Errorf("Sign() cert = %q, want %q", cert, want)
+			}
+			if want := ipa.chain.pem(t, ipa.chain.root); string(chain) != want {
+				t.Errorf("Sign() ca = %q, want %q", chain, want)
+			}
+		})
+	}
+}
+
+// newKeyCSR returns a PEM encoded CSR for the common name, signed with key.
+func newKeyCSR(t *testing.T, key *ecdsa.PrivateKey, commonName string) []byte {
+	t.Helper()
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func Test_sameDN(t *testing.T) {
+	if !sameDN("CN=Certificate Authority, O=EXAMPLE.TEST", "cn=Certificate Authority,o=example.test") {
+		t.Error("sameDN() = false for equal DNs")
+	}
+	if sameDN("CN=team-ca", "CN=team-ca,O=EXAMPLE.TEST") {
+		t.Error("sameDN() = true for different DNs")
+	}
+}
@@ -0,0 +1,91 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+)
+
+// Reasons for an issuer not to be ready to sign certificates.
+const (
+	ReasonConnectionFailed      = "ConnectionFailed"
+	ReasonAuthenticationFailed  = "AuthenticationFailed"
+	ReasonTLSVerificationFailed = "TLSVerificationFailed"
+	ReasonCANotFound            = "CANotFound"
+	ReasonProfileNotFound       = "ProfileNotFound"
+	ReasonInvalidPrincipal      = "InvalidPrincipal"
+	ReasonError                 = "Error"
+)
+
+// VerificationError is a failed check of the FreeIPA setup of an issuer.
+type VerificationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns why err prevents an issuer from signing certificates.
+func Reason(err error) string {
+	var verr *VerificationError
+	switch {
+	case errors.As(err, &verr):
+		return verr.Reason
+	case IsTLSVerificationError(err):
+		return ReasonTLSVerificationFailed
+	case isAuthError(err):
+		return ReasonAuthenticationFailed
+	case isServerError(err):
+		return ReasonConnectionFailed
+	default:
+		return ReasonError
+	}
+}
+
+// Verify checks that the issuer can sign certificates: a FreeIPA server
+// accepts its session, and the CA and the profiles of the spec exist.
+func (s *FreeIPAPKI) Verify(ctx context.Context) error {
+	return s.call(func(client *freeipa.Client) error {
+		if _, err := client.Whoami(&freeipa.WhoamiArgs{}, &freeipa.WhoamiOptionalArgs{}); err != nil {
+			return fmt.Errorf("failed to check FreeIPA session: %w", err)
+		}
+
+		if _, err := client.CaShow(&freeipa.CaShowArgs{Cn: s.spec.Ca}, &freeipa.CaShowOptionalArgs{}); err != nil {
+			var ipaErr *freeipa.Error
+			if errors.As(err, &ipaErr) && ipaErr.Code == freeipa.NotFoundCode {
+				return &VerificationError{Reason: ReasonCANotFound, Err: fmt.Errorf("CA %q not found: %w", s.spec.Ca, err)}
+			}
+			return fmt.Errorf("failed to get CA %q: %w", s.spec.Ca, err)
+		}
+
+		var profiles []string
+		if s.spec.Profile != "" {
+			profiles = append(profiles, s.spec.Profile)
+		}
+		profiles = append(profiles, s.spec.AllowedProfiles...)
+		for _, m := range s.spec.ProfileMappings {
+			profiles = append(profiles, m.Profile)
+		}
+		for _, profile := range profiles {
+			// Out makes FreeIPA return the configuration of the profile, which
+			// the client requires.
+			if _, err := client.CertprofileShow(&freeipa.CertprofileShowArgs{Cn: profile}, &freeipa.CertprofileShowOptionalArgs{Out: freeipa.String(profile)}); err != nil {
+				var ipaErr *freeipa.Error
+				if errors.As(err, &ipaErr) && ipaErr.Code == freeipa.NotFoundCode {
+					return &VerificationError{Reason: ReasonProfileNotFound, Err: fmt.Errorf("profile %q not found: %w", profile, err)}
+				}
+				return fmt.Errorf("failed to get profile %q: %w", profile, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package provisioners
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ccin2p3/go-freeipa/freeipa"
+	api "github.com/guilhem/freeipa-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestVerify(t *testing.T) {
+	ipa := newFakeIPA(t)
+	ipa.user = "admin"
+	ipa.password = "secret"
+	ipa.handle("whoami", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		return map[string]interface{}{"object": "user", "command": "user_show/1", "arguments": []interface{}{"admin"}}, nil
+	})
+	ipa.handle("ca_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		if options["cn"] != "ipa" {
+			return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "CA not found"}
+		}
+		return map[string]interface{}{
+			"value": "ipa",
+			"result": map[string]interface{}{
+				"cn":             []interface{}{"ipa"},
+				"certificate":    "MIIB",
+				"ipacaid":        []interface{}{"5d8ed7b4-5bb2-4e9e-9a7e-6e4c8dd8b5c1"},
+				"ipacaissuerdn":  []interface{}{"CN=Certificate Authority,O=EXAMPLE.TEST"},
+				"ipacasubjectdn": []interface{}{"CN=Certificate Authority,O=EXAMPLE.TEST"},
+			},
+		}, nil
+	})
+
+	ipa.handle("certprofile_show", func(args []interface{}, options map[string]interface{}) (interface{}, *freeipa.Error) {
+		cn, _ := options["cn"].(string)
+		if cn != "caIPAserviceCert" && cn != "shortLived" {
+			return nil, &freeipa.Error{Code: freeipa.NotFoundCode, Name: "NotFound", Message: "profile not found"}
+		}
+		return map[string]interface{}{
+			"value": cn,
+			"result": map[string]interface{}{
+				"cn":          []interface{}{cn},
+				"description": []interface{}{"profile"},
+				"config":      "profileId=" + cn,
+			},
+		}, nil
+	})
+
+	tests := []struct {
+		name            string
+		ca              string
+		profile         string
+		allowedProfiles []string
+		wantReason      string
+	}{
+		{
+			name: "ready",
+			ca:   "ipa",
+		},
+		{
+			name:            "ready with profiles",
+			ca:              "ipa",
+			profile:         "caIPAserviceCert",
+			allowedProfiles: []string{"shortLived"},
+		},
+		{
+			name:       "CA not found",
+			ca:         "missing",
+			wantReason: ReasonCANotFound,
+		},
+		{
+			name:       "profile not found",
+			ca:         "ipa",
+			profile:    "missing",
+			wantReason: ReasonProfileNotFound,
+		},
+		{
+			name:            "allowed profile not found",
+			ca:              "ipa",
+			allowedProfiles: []string{"shortLived", "missing"},
+			wantReason:      ReasonProfileNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &api.IssuerSpec{Host: ipa.host(), Insecure: true, Ca: tt.ca, Profile: tt.profile, AllowedProfiles: tt.allowedProfiles}
+			p, err := New(types.NamespacedName{Name: "issuer", Namespace: "default"}, spec, &Credentials{User: "admin", Password: "secret"})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			err = p.Verify(context.Background())
+			if (err != nil) != (tt.wantReason != "") {
+				t.Fatalf("Verify() error = %v, want reason %q", err, tt.wantReason)
+			}
+			if err != nil && Reason(err) != tt.wantReason {
+				t.Errorf("Reason() = %q, want %q", Reason(err), tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "verification",
+			err:  &VerificationError{Reason: ReasonCANotFound, Err: errors.New("CA not found")},
+			want: ReasonCANotFound,
+		},
+		{
+			name: "invalid password",
+			err:  &freeipa.Error{Code: freeipa.InvalidSessionPasswordCode, Name: "invalid-password"},
+			want: ReasonAuthenticationFailed,
+		},
+		{
+			name: "service unavailable",
+			err:  errors.New("unexpected http status code: 503"),
+			want: ReasonConnectionFailed,
+		},
+		{
+			name: "other",
+			err:  errors.New("boom"),
+			want: ReasonError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Reason(tt.err); got != tt.want {
+				t.Errorf("Reason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}